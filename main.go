@@ -17,69 +17,685 @@ limitations under the License.
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/Mirantis/criproxy/pkg/config"
 	"github.com/Mirantis/criproxy/pkg/proxy"
 	"github.com/Mirantis/criproxy/pkg/utils"
 )
 
-const (
-	// XXX: don't hardcode
-	connectionTimeout = 30 * time.Second
-)
+// envPrefix is the prefix of the environment variables that
+// correspond to the flags
+const envPrefix = "CRIPROXY_"
+
+// logPruneInterval is the interval between the checks for the old
+// log files to remove
+const logPruneInterval = time.Minute
 
 var (
+	configFile = flag.String("config", "",
+		"YAML or JSON config file with the settings to use for the flags that are not set on the command line or in the environment")
 	listen = flag.String("listen", "/run/criproxy.sock",
 		"The unix socket to listen on, e.g. /run/virtlet.sock")
 	connect = flag.String("connect", "/var/run/dockershim.sock",
-		"CRI runtime ids and unix socket(s) to connect to, e.g. /var/run/dockershim.sock,alt:/var/run/another.sock")
-	streamPort    = flag.Int("streamPort", 11250, "streaming port of the default runtime")
-	streamUrl     = flag.String("streamUrl", "", "streaming url of the default runtime (-streamPort is ignored if this value is set)")
-	apiServerHost = flag.String("apiserver", "", "apiserver URL")
-	criVersions   = []proxy.CRIVersion{&proxy.CRI19{}, &proxy.CRI112{}}
+		"CRI runtime ids and unix socket(s) or tcp:// addresses to connect to, e.g. /var/run/dockershim.sock,alt:/var/run/another.sock,remote:tcp://10.0.0.5:9000")
+	connectionTimeout = flag.Duration("connectionTimeout", 10*time.Second,
+		"timeout of each attempt to connect to a runtime; unreachable runtimes are retried in background")
+	streamPort          = flag.Int("streamPort", 11250, "streaming port of the default runtime")
+	streamUrl           = flag.String("streamUrl", "", "streaming url of the default runtime (-streamPort is ignored if this value is set)")
+	streamServerAddress = flag.String("streamServerAddress", "",
+		"host:port to advertise in rewritten Exec/Attach/PortForward urls, e.g. 10.0.0.5:11250 (-streamPort is ignored if this value is set)")
+	apiServerHost  = flag.String("apiserver", "", "apiserver URL")
+	defaultRuntime = flag.String("defaultRuntime", "",
+		"id of the runtime that handles the images without runtime prefix (the primary runtime if not set)")
+	noDefaultRuntime = flag.Bool("noDefaultRuntime", false,
+		"reject the images without runtime prefix instead of passing them to the default runtime")
+	keepaliveTime = flag.Duration("keepaliveTime", 5*time.Minute,
+		"interval between the keepalive pings of the runtime connections (0 disables the pings)")
+	keepaliveTimeout = flag.Duration("keepaliveTimeout", 20*time.Second,
+		"time to wait for keepalive ping response before reconnecting to the runtime")
+	maxParallelImagePulls = flag.Int("maxParallelImagePulls", 0,
+		"max number of PullImage requests passed to each runtime at the same time (0 means no limit)")
+	allowMethods = flag.String("allowMethods", "",
+		"comma-separated list of CRI methods to handle, e.g. RunPodSandbox,ImageService/PullImage (all methods if not set)")
+	denyMethods = flag.String("denyMethods", "",
+		"comma-separated list of CRI methods to reject, e.g. Exec,ExecSync")
+	observe = flag.Bool("observe", false,
+		"pass all of the requests to the primary runtime unchanged, only logging the routing decisions that would be made for them")
+	noImageService = flag.Bool("noImageService", false,
+		"reject all of the image service methods, for use with a separate kubelet --image-service-endpoint")
+	rateLimits = flag.String("rateLimits", "",
+		"comma-separated list of per-runtime CRI method rate limits in requests per second with optional burst, e.g. ListContainers=10:20,ImageStatus=5")
+	registryMirrors = flag.String("registryMirrors", "",
+		"comma-separated list of registry to mirror mappings to pull the images from, e.g. docker.io=mirror.example.com:5000")
+	pullImageSizeMetrics = flag.Bool("pullImageSizeMetrics", false,
+		"request the status of each pulled image to record its size in criproxy_pulled_image_size_bytes metric")
+	cleanupSockets = flag.Bool("cleanupSockets", false,
+		"on startup, remove the sockets named criproxy* in the directory of -listen that nothing listens on")
+	socketMode = flag.String("socketMode", "",
+		"octal file mode to set on the proxy socket, e.g. 0660 (not changed if not set)")
+	socketGroup = flag.String("socketGroup", "",
+		"name or id of the group to set as the owner of the proxy socket (not changed if not set)")
+	allowedUids = flag.String("allowedUids", "",
+		"comma-separated list of uids of the processes allowed to connect to the proxy socket, e.g. 0 (any process if not set)")
+	runtimeHandlers = flag.String("runtimeHandlers", "",
+		"comma-separated list of RuntimeClass handler to runtime id mappings, e.g. kata=virt,runc= (empty id denotes the primary runtime)")
+	traceCalls = flag.Bool("traceCalls", false,
+		"record the traces of CRI calls and serve them at /debug/requests on the -httpListen address")
+	traceRemote = flag.Bool("traceRemote", false,
+		"serve the traces recorded with -traceCalls to any host and not just localhost, with the details such as image names redacted")
+	httpListen = flag.String("httpListen", "",
+		"The address to serve HTTP endpoints such as /metrics on, e.g. :9099 (disabled if not set)")
+	registryAuthFile = flag.String("registryAuthFile", "",
+		"YAML or JSON file that maps runtime ids to the registry credentials to use for PullImage requests without credentials")
+	backendTLSFile = flag.String("backendTLSFile", "",
+		"YAML or JSON file that maps the ids of the runtimes connected to over tcp:// to their TLS settings")
+	maxMessageSize = flag.Int("maxMessageSize", 16*1024*1024,
+		"max size in bytes of gRPC messages received on the proxy socket (gRPC default of 4 MiB is used if set to 0)")
+	healthCheckInterval = flag.Duration("healthCheckInterval", 0,
+		"interval between runtime health checks; Status requests are served from the cached check results (0 disables the checks)")
+	healthCheckRetryInterval = flag.Duration("healthCheckRetryInterval", time.Second,
+		"interval between health checks of the runtimes that are unhealthy")
+	readyFile = flag.String("readyFile", "",
+		"file to create once the proxy socket is ready and all the runtimes are connected, and to remove on shutdown")
+	configzFile = flag.String("configzFile", "",
+		"JSON file with the last applied kubelet config to serve at /configz (disabled if not set)")
+	runtimeApiVersion = flag.String("runtimeApiVersion", "",
+		"CRI API version to report to kubelet (the one reported by the primary runtime if not set)")
+	runtimeName = flag.String("runtimeName", "",
+		"runtime name to report to kubelet (\"criproxy\" if not set)")
+	logMaxSize = flag.Int64("logMaxSize", 100,
+		"size in megabytes after which the log files in -log_dir are rotated (0 disables the rotation)")
+	logMaxBackups = flag.Int("logMaxBackups", 3,
+		"max number of rotated log files in -log_dir to keep for each severity")
+	selfTestImage = flag.String("selfTestImage", "busybox",
+		"image to use for the selftest command")
+	selfTestCRIVersion = flag.String("selfTestCRIVersion", "v1alpha2",
+		"CRI API version to use for the selftest command, v1alpha1 or v1alpha2")
+	printConfig = flag.Bool("printConfig", false,
+		"print the effective configuration as JSON and exit")
+	criVersions = []proxy.CRIVersion{&proxy.CRI19{}, &proxy.CRI112{}}
 )
 
-// runCriProxy starts CRI proxy
-func runCriProxy(connect, listen string) error {
+func proxyOptions() (proxy.RuntimeProxyOptions, error) {
+	handlers, err := splitMap(*runtimeHandlers)
+	if err != nil {
+		return proxy.RuntimeProxyOptions{}, fmt.Errorf("bad runtime handler list: %v", err)
+	}
+	limits, err := parseRateLimits(*rateLimits)
+	if err != nil {
+		return proxy.RuntimeProxyOptions{}, fmt.Errorf("bad rate limit list: %v", err)
+	}
+	mirrors, err := splitMap(*registryMirrors)
+	if err != nil {
+		return proxy.RuntimeProxyOptions{}, fmt.Errorf("bad registry mirror list: %v", err)
+	}
+	var registryAuth map[string]*proxy.RegistryAuth
+	if *registryAuthFile != "" {
+		if registryAuth, err = proxy.LoadRegistryAuth(*registryAuthFile); err != nil {
+			return proxy.RuntimeProxyOptions{}, fmt.Errorf("error loading registry credentials: %v", err)
+		}
+	}
+	var backendTLS map[string]*proxy.BackendTLS
+	if *backendTLSFile != "" {
+		if backendTLS, err = proxy.LoadBackendTLS(*backendTLSFile); err != nil {
+			return proxy.RuntimeProxyOptions{}, fmt.Errorf("error loading runtime TLS settings: %v", err)
+		}
+	}
+	return proxy.RuntimeProxyOptions{
+		DefaultRuntime:           *defaultRuntime,
+		NoDefaultRuntime:         *noDefaultRuntime,
+		KeepaliveTime:            *keepaliveTime,
+		KeepaliveTimeout:         *keepaliveTimeout,
+		MaxParallelImagePulls:    *maxParallelImagePulls,
+		AllowedMethods:           splitList(*allowMethods),
+		DeniedMethods:            splitList(*denyMethods),
+		NoImageService:           *noImageService,
+		Observe:                  *observe,
+		RuntimeHandlers:          handlers,
+		RuntimeApiVersion:        *runtimeApiVersion,
+		RuntimeName:              *runtimeName,
+		RegistryAuth:             registryAuth,
+		MaxMessageSize:           *maxMessageSize,
+		HealthCheckInterval:      *healthCheckInterval,
+		HealthCheckRetryInterval: *healthCheckRetryInterval,
+		BackendTLS:               backendTLS,
+		RateLimits:               limits,
+		RegistryMirrors:          mirrors,
+		PullImageSizeMetrics:     *pullImageSizeMetrics,
+	}, nil
+}
+
+// parseRateLimits parses a comma-separated list of method=rate[:burst]
+// items
+func parseRateLimits(s string) (map[string]proxy.RateLimit, error) {
+	m, err := splitMap(s)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	limits := make(map[string]proxy.RateLimit)
+	for method, value := range m {
+		parts := strings.SplitN(value, ":", 2)
+		var limit proxy.RateLimit
+		if limit.Rate, err = strconv.ParseFloat(parts[0], 64); err != nil {
+			return nil, fmt.Errorf("bad rate for %q: %v", method, err)
+		}
+		if len(parts) == 2 {
+			if limit.Burst, err = strconv.Atoi(parts[1]); err != nil {
+				return nil, fmt.Errorf("bad burst for %q: %v", method, err)
+			}
+		}
+		limits[method] = limit
+	}
+	return limits, nil
+}
+
+// splitList splits a comma-separated list. It returns nil for an
+// empty string.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// splitMap splits a comma-separated list of key=value pairs.
+// It returns nil for an empty string.
+func splitMap(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	m := make(map[string]string)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%q is not a key=value pair", item)
+		}
+		m[parts[0]] = parts[1]
+	}
+	return m, nil
+}
+
+var sensitiveConfigKeyRx = regexp.MustCompile(`(?i)token|password|secret|auth$`)
+
+// redactConfig replaces the values of the config keys that may
+// contain sensitive data
+func redactConfig(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if sensitiveConfigKeyRx.MatchString(k) {
+				v[k] = "<redacted>"
+			} else {
+				v[k] = redactConfig(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactConfig(item)
+		}
+	}
+	return v
+}
+
+// serveConfigz serves the contents of the specified JSON file with
+// the sensitive values redacted
+func serveConfigz(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			glog.Errorf("Error reading %q: %v", path, err)
+			http.Error(w, "config is not available", http.StatusNotFound)
+			return
+		}
+		var config interface{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			glog.Errorf("Error parsing %q: %v", path, err)
+			http.Error(w, "bad config", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(redactConfig(config)); err != nil {
+			glog.Errorf("Error writing /configz response: %v", err)
+		}
+	}
+}
+
+// serveHealthz reports the results of the latest runtime health checks,
+// or the connection states of the runtimes if the health checks are
+// disabled or haven't been done yet. It responds with 503 if any of
+// the runtimes is unhealthy or not connected.
+func serveHealthz(proxies []*proxy.RuntimeProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var health map[string]error
+		for _, p := range proxies {
+			// only the proxy that's used by kubelet does the checks
+			if health = p.RuntimeHealth(); health != nil {
+				break
+			}
+		}
+		if health == nil {
+			// no health checks done, use the connection states
+			health = connectionStates(proxies)
+		}
+		var ids []string
+		healthy := true
+		for id, err := range health {
+			ids = append(ids, id)
+			if err != nil {
+				healthy = false
+			}
+		}
+		sort.Strings(ids)
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		for _, id := range ids {
+			name := id
+			if name == "" {
+				name = "<primary>"
+			}
+			if err := health[id]; err != nil {
+				fmt.Fprintf(w, "%s: %v\n", name, err)
+			} else {
+				fmt.Fprintf(w, "%s: ok\n", name)
+			}
+		}
+	}
+}
+
+// connectionStates returns nil errors for the runtimes that any of the
+// proxies is connected to and errors for the other ones, keyed by
+// runtime id
+func connectionStates(proxies []*proxy.RuntimeProxy) map[string]error {
+	states := make(map[string]error)
+	for _, p := range proxies {
+		for _, b := range p.Backends() {
+			if b.State == "connected" {
+				states[b.Id] = nil
+			} else if _, found := states[b.Id]; !found {
+				states[b.Id] = fmt.Errorf("runtime is %s", b.State)
+			}
+		}
+	}
+	return states
+}
+
+// warnUnreachableRuntimes starts connecting to the runtimes and logs
+// a warning for each runtime that's not connected within the timeout.
+// The connection attempts continue in background.
+func warnUnreachableRuntimes(p *proxy.RuntimeProxy, timeout time.Duration) {
+	done := make(chan error, 1)
+	go func() {
+		done <- p.WaitForRuntimes()
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+	for _, b := range p.Backends() {
+		if b.State != "connected" {
+			name := b.Id
+			if name == "" {
+				name = "<primary>"
+			}
+			glog.Warningf("Runtime %s at %s is not reachable after %v, will keep trying to connect in background", name, b.Endpoint, timeout)
+		}
+	}
+}
+
+// serveBackends lists the runtimes of each proxy as JSON, keyed by
+// the proto package of the proxy's CRI version
+func serveBackends(proxies []*proxy.RuntimeProxy) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		backends := make(map[string][]proxy.BackendInfo)
+		for _, p := range proxies {
+			backends[p.ProtoPackage()] = p.Backends()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(backends); err != nil {
+			glog.Errorf("Error writing /backends response: %v", err)
+		}
+	}
+}
+
+// httpHandler returns the handler for the HTTP endpoints. /healthz
+// is always served, reporting the connection states of the runtimes
+// when the health checks are disabled.
+func httpHandler(proxies []*proxy.RuntimeProxy) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/backends", serveBackends(proxies))
+	mux.HandleFunc("/healthz", serveHealthz(proxies))
+	if *configzFile != "" {
+		mux.HandleFunc("/configz", serveConfigz(*configzFile))
+	}
+	if *traceCalls {
+		mux.HandleFunc("/debug/requests", proxy.TraceHandler)
+	}
+	return mux
+}
+
+// serveHTTP serves the metrics and other HTTP endpoints of the proxy
+func serveHTTP(addr string, proxies []*proxy.RuntimeProxy) {
+	glog.V(1).Infof("Serving HTTP endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, httpHandler(proxies)); err != nil {
+		glog.Errorf("HTTP server failed: %v", err)
+	}
+}
+
+// resolveRoutes prints the runtimes that will handle the specified
+// images without contacting any runtimes
+func resolveRoutes(connect string, images []string) error {
 	addrs := strings.Split(connect, ",")
-	var err error
-	var realStreamUrl *url.URL
-	if *streamUrl == "" {
-		if realStreamUrl, err = utils.GetStreamUrl(*streamPort); err != nil {
-			return fmt.Errorf("can't get stream url: %v", err)
+	opts, err := proxyOptions()
+	if err != nil {
+		return err
+	}
+	p, err := proxy.NewRuntimeProxy(criVersions[0], addrs, *connectionTimeout, &url.URL{}, opts)
+	if err != nil {
+		return fmt.Errorf("error initializing CRI proxy: %v", err)
+	}
+	for _, image := range images {
+		runtime, unprefixed, err := p.ResolveRoute(image)
+		if err != nil {
+			return err
+		}
+		if runtime == "" {
+			runtime = "<primary>"
+		}
+		fmt.Printf("%s\t%s\t%s\n", image, runtime, unprefixed)
+	}
+	return nil
+}
+
+// createReadyFile creates the ready file after the proxy socket is
+// ready and all the runtimes are connected
+func createReadyFile(path string, readyCh chan struct{}, p *proxy.RuntimeProxy) {
+	<-readyCh
+	if err := p.WaitForRuntimes(); err != nil {
+		glog.Errorf("Not creating ready file: %v", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		glog.Errorf("Error creating ready file %q: %v", path, err)
+		return
+	}
+	glog.V(1).Infof("All runtimes are connected, created ready file %s", path)
+}
+
+func removeReadyFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("Error removing ready file %q: %v", path, err)
+	}
+}
+
+// stopOnSignal stops the server upon SIGTERM or SIGINT so
+// that the cleanup can be done. stoppedCh is closed before
+// stopping the server.
+func stopOnSignal(server *proxy.Server, stoppedCh chan struct{}) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	glog.V(1).Infof("Got %v, stopping CRI proxy", sig)
+	close(stoppedCh)
+	server.Stop()
+}
+
+// getStreamUrl returns the streaming url to use for the runtimes
+// that return relative urls
+func getStreamUrl() (*url.URL, error) {
+	switch {
+	case *streamUrl != "":
+		return utils.ParseStreamUrl(*streamUrl)
+	case *streamServerAddress != "":
+		return utils.ParseStreamAddress(*streamServerAddress)
+	default:
+		u, err := utils.GetStreamUrl(*streamPort)
+		if err != nil {
+			return nil, fmt.Errorf("can't get stream url: %v", err)
 		}
+		return u, nil
+	}
+}
+
+type runtimeConfig struct {
+	Id     string `json:"id"`
+	Socket string `json:"socket"`
+}
+
+// effectiveConfig denotes the configuration the proxy will run with
+type effectiveConfig struct {
+	Listen    string          `json:"listen"`
+	Runtimes  []runtimeConfig `json:"runtimes"`
+	StreamUrl string          `json:"streamUrl"`
+	// RuntimeHandlers maps RuntimeClass handlers to runtime ids
+	RuntimeHandlers map[string]string `json:"runtimeHandlers,omitempty"`
+	// RegistryAuthRuntimes lists the ids of the runtimes that have
+	// registry credentials. The credentials themselves are not printed.
+	RegistryAuthRuntimes []string `json:"registryAuthRuntimes,omitempty"`
+	// Flags contains the values of all the flags including
+	// the defaults
+	Flags map[string]string `json:"flags"`
+}
+
+// dumpConfig prints the effective configuration of the proxy as JSON
+func dumpConfig(connect, listen string) error {
+	addrs := strings.Split(connect, ",")
+	realStreamUrl, err := getStreamUrl()
+	if err != nil {
+		return err
+	}
+	opts, err := proxyOptions()
+	if err != nil {
+		return err
+	}
+	// make sure the configuration is valid
+	if _, err := proxy.NewRuntimeProxy(criVersions[0], addrs, *connectionTimeout, realStreamUrl, opts); err != nil {
+		return fmt.Errorf("error initializing CRI proxy: %v", err)
+	}
+
+	config := effectiveConfig{
+		Listen:          listen,
+		StreamUrl:       realStreamUrl.String(),
+		RuntimeHandlers: opts.RuntimeHandlers,
+		Flags:           make(map[string]string),
+	}
+	for _, addr := range addrs {
+		var rc runtimeConfig
+		rc.Id, rc.Socket = proxy.ParseRuntimeAddr(addr)
+		config.Runtimes = append(config.Runtimes, rc)
+	}
+	for id := range opts.RegistryAuth {
+		config.RegistryAuthRuntimes = append(config.RegistryAuthRuntimes, id)
+	}
+	sort.Strings(config.RegistryAuthRuntimes)
+	flag.VisitAll(func(f *flag.Flag) {
+		config.Flags[f.Name] = f.Value.String()
+	})
+
+	out, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// setupLogDir applies the log rotation settings to the log files
+// that glog writes to -log_dir and starts removing the old ones
+// in background. It does nothing if glog logs to stderr.
+func setupLogDir(maxSize int64, maxBackups int) {
+	if flag.Lookup("log_dir").Value.String() == "" || flag.Lookup("logtostderr").Value.String() == "true" {
+		return
+	}
+	if maxSize > 0 {
+		glog.MaxSize = uint64(maxSize) * 1024 * 1024
 	} else {
-		if realStreamUrl, err = url.Parse(*streamUrl); err != nil {
-			return fmt.Errorf("invalid stream url %q: %v", *streamUrl, err)
+		glog.MaxSize = math.MaxUint64
+	}
+	dir := flag.Lookup("log_dir").Value.String()
+	program := filepath.Base(os.Args[0])
+	go func() {
+		for {
+			if _, err := utils.PruneLogFiles(dir, program, maxBackups); err != nil {
+				glog.Warningf("Error removing old log files: %v", err)
+			}
+			time.Sleep(logPruneInterval)
 		}
+	}()
+}
+
+// runCriProxy starts CRI proxy
+func runCriProxy(connect, listen string) error {
+	addrs := strings.Split(connect, ",")
+	realStreamUrl, err := getStreamUrl()
+	if err != nil {
+		return err
+	}
+	opts, err := proxyOptions()
+	if err != nil {
+		return err
 	}
 	var interceptors []proxy.Interceptor
+	var proxies []*proxy.RuntimeProxy
 	for _, criVersion := range criVersions {
-		proxy, err := proxy.NewRuntimeProxy(criVersion, addrs, connectionTimeout, realStreamUrl)
+		proxy, err := proxy.NewRuntimeProxy(criVersion, addrs, *connectionTimeout, realStreamUrl, opts)
 		if err != nil {
 			return fmt.Errorf("error initializing CRI proxy: %v", err)
 		}
 		interceptors = append(interceptors, proxy)
+		proxies = append(proxies, proxy)
+	}
+	server := proxy.NewServer(interceptors, nil, opts.ServerOptions()...)
+	var mode os.FileMode
+	gid := -1
+	if *socketMode != "" {
+		if mode, err = utils.ParseFileMode(*socketMode); err != nil {
+			return err
+		}
+	}
+	if *socketGroup != "" {
+		if gid, err = utils.LookupGid(*socketGroup); err != nil {
+			return fmt.Errorf("bad socket group %q: %v", *socketGroup, err)
+		}
+	}
+	server.SetSocketPermissions(mode, gid)
+	var uids []uint32
+	for _, s := range splitList(*allowedUids) {
+		uid, err := strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			return fmt.Errorf("bad uid %q: %v", s, err)
+		}
+		uids = append(uids, uint32(uid))
+	}
+	server.SetAllowedUids(uids)
+	if *traceCalls {
+		proxy.EnableTracing(*traceRemote)
+	}
+	if *httpListen != "" {
+		go serveHTTP(*httpListen, proxies)
+	}
+	// proxies[0] handles the oldest CRI version, so it can
+	// connect to any of the runtimes
+	go warnUnreachableRuntimes(proxies[0], *connectionTimeout)
+	var readyCh chan struct{}
+	if *readyFile != "" {
+		if err := os.Remove(*readyFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing stale ready file: %v", err)
+		}
+		readyCh = make(chan struct{})
+		// the first CRI version is the oldest one and its
+		// proxy can talk to any runtime
+		go createReadyFile(*readyFile, readyCh, proxies[0])
+		defer removeReadyFile(*readyFile)
+	}
+	stoppedCh := make(chan struct{})
+	go stopOnSignal(server, stoppedCh)
+	if *cleanupSockets {
+		removed, err := utils.CleanupOrphanedSockets(filepath.Dir(listen))
+		for _, path := range removed {
+			glog.Infof("Removed orphaned socket %s", path)
+		}
+		if err != nil {
+			glog.Warningf("Failed to clean up orphaned sockets: %v", err)
+		}
 	}
 	glog.V(1).Infof("Starting CRI proxy on socket %s", listen)
-	server := proxy.NewServer(interceptors, nil)
-	if err := server.Serve(listen, nil); err != nil {
-		return fmt.Errorf("serving failed: %v", err)
+	if err := server.Serve(listen, readyCh); err != nil {
+		select {
+		case <-stoppedCh:
+			// the listener is closed when the server is stopped
+		default:
+			return fmt.Errorf("serving failed: %v", err)
+		}
 	}
 	return nil
 }
 
+// applyConfigFile sets the flags that weren't set on the command
+// line or in the environment from the config file
+func applyConfigFile(path string) error {
+	c, err := config.Load(path)
+	if err != nil {
+		return fmt.Errorf("error loading the config file: %v", err)
+	}
+	return c.Apply(flag.CommandLine)
+}
+
+// exitWithError logs the error and exits, making sure the buffered
+// log entries are written to the log files before that
+func exitWithError(err error) {
+	glog.Error(err)
+	glog.Flush()
+	os.Exit(1)
+}
+
 func main() {
 	flag.Parse()
-	if err := runCriProxy(*connect, *listen); err != nil {
-		glog.Error(err)
-		os.Exit(1)
+	if err := utils.SetFlagsFromEnv(flag.CommandLine, envPrefix); err != nil {
+		exitWithError(err)
+	}
+	if *configFile != "" {
+		if err := applyConfigFile(*configFile); err != nil {
+			exitWithError(err)
+		}
+	}
+	setupLogDir(*logMaxSize, *logMaxBackups)
+	var err error
+	switch {
+	case flag.NArg() > 0 && flag.Arg(0) == "route":
+		err = resolveRoutes(*connect, flag.Args()[1:])
+	case flag.NArg() > 0 && flag.Arg(0) == "selftest":
+		err = selfTest(*connect, *listen, *selfTestImage, *selfTestCRIVersion)
+	case flag.NArg() > 0:
+		err = fmt.Errorf("unknown command %q", flag.Arg(0))
+	case *printConfig:
+		err = dumpConfig(*connect, *listen)
+	default:
+		err = runCriProxy(*connect, *listen)
+	}
+	if err != nil {
+		exitWithError(err)
 	}
+	glog.Flush()
 }
@@ -0,0 +1,173 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Mirantis/criproxy/pkg/proxy"
+	proxytest "github.com/Mirantis/criproxy/pkg/proxy/testing"
+)
+
+func TestHealthzWithUnreachableRuntime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "criproxy-healthz")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the second runtime never comes up
+	addr := filepath.Join(dir, "runtime1.sock")
+	server := proxytest.NewFakeCriServer19(proxytest.NewSimpleJournal(), "/cri")
+	startServer(t, server, addr)
+	defer server.Stop()
+	addrs := []string{addr, "alt:" + filepath.Join(dir, "nosuchruntime.sock")}
+
+	timeout := 500 * time.Millisecond
+	var proxies []*proxy.RuntimeProxy
+	for _, criVersion := range criVersions {
+		p, err := proxy.NewRuntimeProxy(criVersion, addrs, timeout, &url.URL{}, proxy.RuntimeProxyOptions{})
+		if err != nil {
+			t.Fatalf("NewRuntimeProxy(): %v", err)
+		}
+		defer p.Stop()
+		proxies = append(proxies, p)
+	}
+	// this starts connecting to the runtimes in background.
+	// WaitForRuntimes() can't be used to wait for the primary
+	// runtime as it never returns while the other runtime is
+	// unreachable
+	warnUnreachableRuntimes(proxies[0], timeout)
+	primaryConnected := func() bool {
+		for _, b := range proxies[0].Backends() {
+			if b.Id == "" {
+				return b.State == "connected"
+			}
+		}
+		return false
+	}
+	for deadline := time.Now().Add(10 * time.Second); !primaryConnected(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the primary runtime to connect")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// the health checks are disabled, so /healthz must report
+	// the connection states
+	s := httptest.NewServer(httpHandler(proxies))
+	defer s.Close()
+	resp, err := http.Get(s.URL + "/healthz")
+	if err != nil {
+		t.Fatalf("GET /healthz: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading /healthz response: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/healthz returned status %d instead of %d", resp.StatusCode, http.StatusServiceUnavailable)
+	}
+	for _, expected := range []string{"<primary>: ok\n", "alt: runtime is "} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("/healthz response doesn't contain %q:\n%s", expected, body)
+		}
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name, config, expected string
+	}{
+		{
+			name:     "no secrets",
+			config:   `{"address":"0.0.0.0","port":10250,"readOnly":false,"clusterDNS":["10.96.0.10"]}`,
+			expected: `{"address":"0.0.0.0","port":10250,"readOnly":false,"clusterDNS":["10.96.0.10"]}`,
+		},
+		{
+			name:     "top level secrets",
+			config:   `{"bootstrapToken":"abc.def","Password":"foo","clientSecret":"bar","port":10250}`,
+			expected: `{"bootstrapToken":"<redacted>","Password":"<redacted>","clientSecret":"<redacted>","port":10250}`,
+		},
+		{
+			name:     "nested secrets",
+			config:   `{"registries":[{"server":"example.com","auth":"dXNlcjpwYXNz","identityToken":{"value":"xyz"}}],"kube":{"api":{"password":"foo","user":"admin"}}}`,
+			expected: `{"registries":[{"server":"example.com","auth":"<redacted>","identityToken":"<redacted>"}],"kube":{"api":{"password":"<redacted>","user":"admin"}}}`,
+		},
+		{
+			name:     "auth keys",
+			config:   `{"registryAuth":{"alt":"foo"},"authentication":{"anonymous":{"enabled":false}},"authorization":{"mode":"Webhook"}}`,
+			expected: `{"registryAuth":"<redacted>","authentication":{"anonymous":{"enabled":false}},"authorization":{"mode":"Webhook"}}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var config, expected interface{}
+			if err := json.Unmarshal([]byte(tc.config), &config); err != nil {
+				t.Fatalf("error parsing the config: %v", err)
+			}
+			if err := json.Unmarshal([]byte(tc.expected), &expected); err != nil {
+				t.Fatalf("error parsing the expected config: %v", err)
+			}
+			if redacted := redactConfig(config); !reflect.DeepEqual(redacted, expected) {
+				t.Errorf("bad redacted config %#v instead of %#v", redacted, expected)
+			}
+		})
+	}
+}
+
+func TestServeConfigz(t *testing.T) {
+	dir, err := ioutil.TempDir("", "criproxy-configz")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kubelet.json")
+	if err := ioutil.WriteFile(path, []byte(`{"port":10250,"auth":{"token":"abc"}}`), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	serveConfigz(path)(w, httptest.NewRequest("GET", "/configz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("/configz returned status %d", w.Code)
+	}
+	var config interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatalf("error parsing /configz response: %v", err)
+	}
+	expected := map[string]interface{}{"auth": "<redacted>", "port": float64(10250)}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("bad /configz response %#v instead of %#v", config, expected)
+	}
+
+	w = httptest.NewRecorder()
+	serveConfigz(filepath.Join(dir, "nosuchfile.json"))(w, httptest.NewRequest("GET", "/configz", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("/configz returned status %d instead of %d for a missing file", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config defines the structured configuration file of CRI
+// proxy that can be used instead of the command line flags.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// Duration is a time.Duration that's represented as a string such
+// as "5m" in the config file.
+type Duration struct {
+	time.Duration
+}
+
+// MarshalJSON implements json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Runtime describes a runtime to connect to.
+type Runtime struct {
+	// Id is the id of the runtime that's used as the prefix of
+	// its images and objects. It's empty for the primary runtime.
+	Id string `json:"id,omitempty"`
+	// Endpoint is the path of the unix socket of the runtime or
+	// its tcp:// address.
+	Endpoint string `json:"endpoint"`
+}
+
+// Config is the configuration of CRI proxy. Each of the fields
+// corresponds to a command line flag, and the fields that are not
+// set leave the flag at its default value.
+type Config struct {
+	// Listen is the unix socket to listen on (-listen).
+	Listen string `json:"listen,omitempty"`
+	// Runtimes are the runtimes to connect to, with the primary
+	// one listed first (-connect).
+	Runtimes []Runtime `json:"runtimes,omitempty"`
+	// DefaultRuntime is the id of the runtime that handles the
+	// images without runtime prefix (-defaultRuntime).
+	DefaultRuntime string `json:"defaultRuntime,omitempty"`
+	// ConnectionTimeout is the timeout of each attempt to connect
+	// to a runtime (-connectionTimeout).
+	ConnectionTimeout *Duration `json:"connectionTimeout,omitempty"`
+	// KeepaliveTime is the interval between the keepalive pings of
+	// the runtime connections, 0 disables the pings (-keepaliveTime).
+	KeepaliveTime *Duration `json:"keepaliveTime,omitempty"`
+	// KeepaliveTimeout is the time to wait for keepalive ping
+	// response (-keepaliveTimeout).
+	KeepaliveTimeout *Duration `json:"keepaliveTimeout,omitempty"`
+	// HealthCheckInterval is the interval between runtime health
+	// checks (-healthCheckInterval).
+	HealthCheckInterval *Duration `json:"healthCheckInterval,omitempty"`
+	// HealthCheckRetryInterval is the interval between health
+	// checks of the unhealthy runtimes (-healthCheckRetryInterval).
+	HealthCheckRetryInterval *Duration `json:"healthCheckRetryInterval,omitempty"`
+	// LogDir is the directory for glog to write the log files
+	// to (-log_dir).
+	LogDir string `json:"logDir,omitempty"`
+	// LogMaxSize is the size in megabytes after which the log
+	// files are rotated (-logMaxSize).
+	LogMaxSize *int64 `json:"logMaxSize,omitempty"`
+	// LogMaxBackups is the max number of rotated log files to
+	// keep (-logMaxBackups).
+	LogMaxBackups *int `json:"logMaxBackups,omitempty"`
+	// LogLevel is the log verbosity (-v).
+	LogLevel *int `json:"logLevel,omitempty"`
+	// Flags contains the values of any other flags, keyed by flag
+	// name without the leading dash.
+	Flags map[string]string `json:"flags,omitempty"`
+}
+
+// Load loads the config from a YAML or JSON file.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("error parsing %q: %v", path, err)
+	}
+	return &c, nil
+}
+
+// FlagValues returns the values of the flags that correspond to the
+// config, keyed by flag name.
+func (c *Config) FlagValues() map[string]string {
+	values := make(map[string]string)
+	for name, value := range c.Flags {
+		values[name] = value
+	}
+	setString := func(name, value string) {
+		if value != "" {
+			values[name] = value
+		}
+	}
+	setDuration := func(name string, d *Duration) {
+		if d != nil {
+			values[name] = d.Duration.String()
+		}
+	}
+	setString("listen", c.Listen)
+	if len(c.Runtimes) != 0 {
+		var addrs []string
+		for _, r := range c.Runtimes {
+			if r.Id == "" {
+				addrs = append(addrs, r.Endpoint)
+			} else {
+				addrs = append(addrs, r.Id+":"+r.Endpoint)
+			}
+		}
+		values["connect"] = strings.Join(addrs, ",")
+	}
+	setString("defaultRuntime", c.DefaultRuntime)
+	setDuration("connectionTimeout", c.ConnectionTimeout)
+	setDuration("keepaliveTime", c.KeepaliveTime)
+	setDuration("keepaliveTimeout", c.KeepaliveTimeout)
+	setDuration("healthCheckInterval", c.HealthCheckInterval)
+	setDuration("healthCheckRetryInterval", c.HealthCheckRetryInterval)
+	setString("log_dir", c.LogDir)
+	if c.LogMaxSize != nil {
+		values["logMaxSize"] = strconv.FormatInt(*c.LogMaxSize, 10)
+	}
+	if c.LogMaxBackups != nil {
+		values["logMaxBackups"] = strconv.Itoa(*c.LogMaxBackups)
+	}
+	if c.LogLevel != nil {
+		values["v"] = strconv.Itoa(*c.LogLevel)
+	}
+	return values
+}
+
+// Apply sets the flags that weren't set yet, e.g. on the command
+// line or from the environment, from the config. So any flags that
+// are set explicitly take precedence over the config file.
+func (c *Config) Apply(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, value := range c.FlagValues() {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag %q in the config", name)
+		}
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("bad value of %q in the config: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const sampleConfig = `
+listen: /run/criproxy.sock
+runtimes:
+- endpoint: /var/run/dockershim.sock
+- id: virtlet.cloud
+  endpoint: /run/virtlet.sock
+keepaliveTime: 1m
+logLevel: 2
+flags:
+  maxParallelImagePulls: "3"
+`
+
+func writeConfig(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "criproxy-config-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestLoad(t *testing.T) {
+	path, cleanup := writeConfig(t, sampleConfig)
+	defer cleanup()
+
+	c, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	expected := map[string]string{
+		"listen":                "/run/criproxy.sock",
+		"connect":               "/var/run/dockershim.sock,virtlet.cloud:/run/virtlet.sock",
+		"keepaliveTime":         "1m0s",
+		"v":                     "2",
+		"maxParallelImagePulls": "3",
+	}
+	if values := c.FlagValues(); !reflect.DeepEqual(values, expected) {
+		t.Errorf("bad flag values: %#v instead of %#v", values, expected)
+	}
+
+	if _, err := Load(filepath.Join(filepath.Dir(path), "nonexistent.yaml")); err == nil {
+		t.Errorf("Load() didn't fail for a nonexistent file")
+	}
+	badPath, cleanup := writeConfig(t, "keepaliveTime: forever\n")
+	defer cleanup()
+	if _, err := Load(badPath); err == nil {
+		t.Errorf("Load() didn't fail for a bad duration")
+	}
+}
+
+func TestApply(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	listen := fs.String("listen", "/run/default.sock", "")
+	connect := fs.String("connect", "/var/run/dockershim.sock", "")
+	keepaliveTime := fs.Duration("keepaliveTime", 5*time.Minute, "")
+	defaultRuntime := fs.String("defaultRuntime", "", "")
+	if err := fs.Parse([]string{"-listen", "/run/flag.sock"}); err != nil {
+		t.Fatalf("Parse(): %v", err)
+	}
+
+	c := &Config{
+		Listen:        "/run/config.sock",
+		Runtimes:      []Runtime{{Endpoint: "/run/primary.sock"}, {Id: "alt", Endpoint: "tcp://10.0.0.5:9000"}},
+		KeepaliveTime: &Duration{time.Minute},
+	}
+	if err := c.Apply(fs); err != nil {
+		t.Fatalf("Apply(): %v", err)
+	}
+	if *listen != "/run/flag.sock" {
+		t.Errorf("the flag didn't take precedence over the config: listen = %q", *listen)
+	}
+	if *connect != "/run/primary.sock,alt:tcp://10.0.0.5:9000" {
+		t.Errorf("connect wasn't set from the config: %q", *connect)
+	}
+	if *keepaliveTime != time.Minute {
+		t.Errorf("keepaliveTime wasn't set from the config: %v", *keepaliveTime)
+	}
+	if *defaultRuntime != "" {
+		t.Errorf("defaultRuntime doesn't have the default value: %q", *defaultRuntime)
+	}
+
+	c = &Config{Flags: map[string]string{"noSuchFlag": "1"}}
+	if err := c.Apply(fs); err == nil {
+		t.Errorf("Apply() didn't fail for an unknown flag")
+	}
+}
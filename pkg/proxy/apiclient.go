@@ -30,6 +30,7 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/Mirantis/criproxy/pkg/utils"
 )
@@ -51,10 +52,12 @@ type client interface {
 	getID() string
 	isPrimary() bool
 	currentState() clientState
+	getAddr() string
 	connect() chan error
 	stop()
 	handleError(err error, tolerateDisconnect bool) error
 	imageName(unprefixedName string) string
+	setImagePrefix(prefix string)
 	augmentId(id string) string
 	annotationsMatch(annotations map[string]string) bool
 	idPrefixMatches(id string) (bool, string)
@@ -73,16 +76,33 @@ type clientConnection struct {
 	probe             clientProbeFunc
 	state             clientState
 	connectionTimeout time.Duration
-	connectErrChs     []chan error
+	// creds are used to secure the connection. If it's nil, the
+	// connection is insecure, which is ok for unix sockets.
+	creds         credentials.TransportCredentials
+	connectErrChs []chan error
+	// keepalive holds the settings of the keepalive pings which
+	// are made using keepalivePing while the runtime is connected
+	keepalive     keepaliveParams
+	keepalivePing clientProbeFunc
 }
 
-func newClientConnection(addr string, connectionTimeout time.Duration) *clientConnection {
+func newClientConnection(addr string, connectionTimeout time.Duration, creds credentials.TransportCredentials) *clientConnection {
 	return &clientConnection{
 		addr:              addr,
 		connectionTimeout: connectionTimeout,
+		creds:             creds,
 	}
 }
 
+func (c *clientConnection) transportOption() grpc.DialOption {
+	if c.creds != nil {
+		return grpc.WithTransportCredentials(c.creds)
+	}
+	return grpc.WithInsecure()
+}
+
+func (c *clientConnection) getAddr() string { return c.addr }
+
 func (c *clientConnection) currentState() clientState {
 	c.Lock()
 	defer c.Unlock()
@@ -108,7 +128,7 @@ func (c *clientConnection) connectNonLocked() chan error {
 		var conn *grpc.ClientConn
 		if err := utils.WaitForSocket(c.addr, -1, func() error {
 			var err error
-			conn, err = grpc.Dial(c.addr, grpc.WithInsecure(), grpc.WithTimeout(c.connectionTimeout), grpc.WithDialer(utils.Dial))
+			conn, err = grpc.Dial(c.addr, c.transportOption(), grpc.WithTimeout(c.connectionTimeout), grpc.WithDialer(utils.Dial))
 			if err == nil && c.probe != nil {
 				err = c.probe(conn, c.connectionTimeout)
 				if err != nil {
@@ -130,6 +150,9 @@ func (c *clientConnection) connectNonLocked() chan error {
 		glog.V(1).Infof("Connected to runtime service %s", c.addr)
 		c.state = clientStateConnected
 		c.conn = conn
+		if c.keepalive.time > 0 && c.keepalivePing != nil {
+			go c.keepaliveLoop(conn)
+		}
 
 		for _, ch := range c.connectErrChs {
 			ch <- nil
@@ -139,6 +162,40 @@ func (c *clientConnection) connectNonLocked() chan error {
 	return errCh
 }
 
+// keepaliveLoop pings the runtime periodically while conn is the
+// current connection and reconnects to the runtime if it doesn't
+// respond. gRPC keepalive can't be used for this as the pinned
+// gRPC version doesn't support it, so the pings are made using
+// ordinary CRI requests, which also means that the runtimes don't
+// reject them as too frequent even if the connection is idle.
+func (c *clientConnection) keepaliveLoop(conn *grpc.ClientConn) {
+	timeout := c.keepalive.timeout
+	if timeout <= 0 {
+		timeout = c.connectionTimeout
+	}
+	for {
+		time.Sleep(c.keepalive.time)
+		c.Lock()
+		current := c.conn == conn
+		c.Unlock()
+		if !current {
+			return
+		}
+		err := c.keepalivePing(conn, timeout)
+		if err == nil {
+			continue
+		}
+		glog.Warningf("Keepalive ping of runtime service %s failed, reconnecting: %v", c.addr, err)
+		c.Lock()
+		if c.conn == conn {
+			c.stopNonLocked()
+			c.connectNonLocked()
+		}
+		c.Unlock()
+		return
+	}
+}
+
 func (c *clientConnection) connect() chan error {
 	c.Lock()
 	defer c.Unlock()
@@ -167,7 +224,9 @@ func (c *clientConnection) stop() {
 // starts trying to reestablish the connection. In case if
 // tolerateDisconnect is true, it also returns nil in this case. In
 // other cases, including non-'Unavailable' errors, it returns the
-// original err value
+// error with the runtime address added to its description, keeping
+// the grpc code of the original error so that e.g. 'Unimplemented'
+// errors reach kubelet as such
 func (c *clientConnection) handleError(err error, tolerateDisconnect bool) error {
 	if grpc.Code(err) == codes.Unavailable {
 		c.Lock()
@@ -179,11 +238,20 @@ func (c *clientConnection) handleError(err error, tolerateDisconnect bool) error
 			return nil
 		}
 	}
-	return fmt.Errorf("%q: %v", c.addr, err)
+	return grpc.Errorf(grpc.Code(err), "%q: %s", c.addr, grpc.ErrorDesc(err))
 }
 
 type clientBase struct {
 	id string
+	// imagePrefix is the prefix of the names of the images that
+	// are handled by the runtime, without the trailing slash. It's
+	// the same as the id except for the primary runtime, which has
+	// no image prefix unless it isn't the default runtime.
+	imagePrefix string
+}
+
+func newClientBase(id string) clientBase {
+	return clientBase{id: id, imagePrefix: id}
 }
 
 func (c *clientBase) getID() string { return c.id }
@@ -193,10 +261,14 @@ func (c *clientBase) isPrimary() bool {
 }
 
 func (c *clientBase) imageName(unprefixedName string) string {
-	if c.isPrimary() {
+	if c.imagePrefix == "" {
 		return unprefixedName
 	}
-	return c.id + "/" + unprefixedName
+	return c.imagePrefix + "/" + unprefixedName
+}
+
+func (c *clientBase) setImagePrefix(prefix string) {
+	c.imagePrefix = prefix
 }
 
 func (c *clientBase) augmentId(id string) string {
@@ -227,10 +299,10 @@ func (c *clientBase) idPrefixMatches(id string) (bool, string) {
 
 func (c *clientBase) imageMatches(imageName string) (bool, string) {
 	switch {
-	case c.isPrimary():
+	case c.imagePrefix == "":
 		return true, imageName
-	case strings.HasPrefix(imageName, c.id+"/"):
-		return true, imageName[len(c.id)+1:]
+	case strings.HasPrefix(imageName, c.imagePrefix+"/"):
+		return true, imageName[len(c.imagePrefix)+1:]
 	default:
 		return false, ""
 	}
@@ -246,7 +318,7 @@ func (c *clientBase) prefixSandbox(unprefixedSandbox PodSandbox) PodSandbox {
 }
 
 func (c *clientBase) prefixContainer(unprefixedContainer Container) Container {
-	if c.isPrimary() {
+	if c.isPrimary() && c.imagePrefix == "" {
 		return unprefixedContainer
 	}
 	container := unprefixedContainer.Copy()
@@ -269,7 +341,7 @@ func (c *clientBase) prefixContainerStats(unprefixedStats ContainerStats) Contai
 }
 
 func (c *clientBase) prefixImage(unprefixedImage Image) Image {
-	if c.isPrimary() {
+	if c.imagePrefix == "" {
 		return unprefixedImage
 	}
 	image := unprefixedImage.Copy()
@@ -320,9 +392,9 @@ type apiClient struct {
 
 var _ client = &apiClient{}
 
-func newApiClient(criVersion CRIVersion, clientConn *clientConnection, id string) *apiClient {
+func newApiClient(criVersion CRIVersion, clientConn *clientConnection, base clientBase) *apiClient {
 	return &apiClient{
-		clientBase:       clientBase{id},
+		clientBase:       base,
 		criVersion:       criVersion,
 		clientConnection: clientConn,
 	}
@@ -441,23 +513,39 @@ type autoClient struct {
 	*clientConnection
 	proxyCRIVersion CRIVersion
 	next            client
+	// nextCRIVersion is the CRI version used to talk to the
+	// runtime, as detected upon connecting
+	nextCRIVersion CRIVersion
+	// limiters limit the rate of the requests by method
+	limiters map[string]*rateLimiter
 }
 
 var _ client = &autoClient{}
 
-func newAutoClient(proxyCRIVersion CRIVersion, addr string, connectionTimeout time.Duration) *autoClient {
-	id := ""
+// ParseRuntimeAddr splits the runtime address in [id:]path or
+// [id:]tcp://host:port form into the runtime id and the socket
+// path or tcp:// address.
+func ParseRuntimeAddr(addr string) (string, string) {
+	if utils.IsTCPAddr(addr) {
+		return "", addr
+	}
 	parts := strings.SplitN(addr, ":", 2)
 	if len(parts) == 2 {
-		id, addr = parts[0], parts[1]
+		return parts[0], parts[1]
 	}
-	conn := newClientConnection(addr, connectionTimeout)
+	return "", addr
+}
+
+func newAutoClient(proxyCRIVersion CRIVersion, addr string, connectionTimeout time.Duration, creds credentials.TransportCredentials) *autoClient {
+	id, addr := ParseRuntimeAddr(addr)
+	conn := newClientConnection(addr, connectionTimeout, creds)
 	c := &autoClient{
-		clientBase:       clientBase{id},
+		clientBase:       newClientBase(id),
 		clientConnection: conn,
 		proxyCRIVersion:  proxyCRIVersion,
 	}
 	conn.probe = c.checkConnection
+	conn.keepalivePing = c.ping
 	return c
 }
 
@@ -480,17 +568,28 @@ func (c *autoClient) checkConnection(conn *grpc.ClientConn, connectionTimeout ti
 	var err error
 	for n, v := range toTry {
 		if err = c.checkVersion(v, conn, connectionTimeout); err == nil {
-			var next client = newApiClient(v, c.clientConnection, c.id)
+			var next client = newApiClient(v, c.clientConnection, c.clientBase)
 			if upgrade[n] {
 				next = newUpgradingClient(next, upgradableVersion)
 			}
+			c.Lock()
 			c.next = next
+			c.nextCRIVersion = v
+			c.Unlock()
 			break
 		}
 	}
 	return err
 }
 
+// ping checks whether the runtime still responds on the connection
+func (c *autoClient) ping(conn *grpc.ClientConn, timeout time.Duration) error {
+	c.Lock()
+	criVersion := c.nextCRIVersion
+	c.Unlock()
+	return c.checkVersion(criVersion, conn, timeout)
+}
+
 func (c *autoClient) getNext() (client, error) {
 	c.Lock()
 	defer c.Unlock()
@@ -505,7 +604,13 @@ func (c *autoClient) invoke(ctx context.Context, method string, req, resp CRIObj
 	if err != nil {
 		return nil, err
 	}
-	return next.invoke(ctx, method, req, resp)
+	if err := checkRateLimit(c.limiters, c, method); err != nil {
+		return nil, err
+	}
+	done := traceRuntimeCall(ctx, method, c)
+	r, err := next.invoke(ctx, method, req, resp)
+	done(err)
+	return r, err
 }
 
 func (c *autoClient) invokeWithErrorHandling(ctx context.Context, method string, req, resp CRIObject) (CRIObject, error) {
@@ -513,7 +618,13 @@ func (c *autoClient) invokeWithErrorHandling(ctx context.Context, method string,
 	if err != nil {
 		return nil, err
 	}
-	return next.invokeWithErrorHandling(ctx, method, req, resp)
+	if err := checkRateLimit(c.limiters, c, method); err != nil {
+		return nil, err
+	}
+	done := traceRuntimeCall(ctx, method, c)
+	r, err := next.invokeWithErrorHandling(ctx, method, req, resp)
+	done(err)
+	return r, err
 }
 
 // TODO: handle grpc's ClientTransport.Error() to reconnect
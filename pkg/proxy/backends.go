@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"time"
+)
+
+// BackendInfo describes a runtime the proxy passes requests to.
+type BackendInfo struct {
+	// Id is the runtime id, which is empty for the primary runtime.
+	Id string `json:"id"`
+	// Default is true if the runtime handles unprefixed images.
+	Default bool `json:"default"`
+	// ImagePrefix is the prefix of the images handled by the runtime.
+	ImagePrefix string `json:"imagePrefix,omitempty"`
+	// IdPrefix is the prefix of pod sandbox and container ids of
+	// the runtime.
+	IdPrefix string `json:"idPrefix,omitempty"`
+	// Endpoint is the socket path or tcp:// address of the runtime.
+	Endpoint string `json:"endpoint"`
+	// State is the state of the connection to the runtime.
+	State string `json:"state"`
+	// Healthy is the result of the latest health check, if any.
+	Healthy *bool `json:"healthy,omitempty"`
+	// HealthError is the error returned by the latest health check.
+	HealthError string `json:"healthError,omitempty"`
+	// LastHealthCheck is the time of the latest health check.
+	LastHealthCheck *time.Time `json:"lastHealthCheck,omitempty"`
+}
+
+func (s clientState) String() string {
+	switch s {
+	case clientStateConnecting:
+		return "connecting"
+	case clientStateConnected:
+		return "connected"
+	default:
+		// the initial zero state also means offline
+		return "offline"
+	}
+}
+
+// ProtoPackage returns the proto package of CRI version handled
+// by the proxy.
+func (r *RuntimeProxy) ProtoPackage() string {
+	return r.criVersion.ProtoPackage()
+}
+
+// Backends returns the information about the runtimes without
+// contacting them.
+func (r *RuntimeProxy) Backends() []BackendInfo {
+	var backends []BackendInfo
+	for _, client := range r.clients {
+		info := BackendInfo{
+			Id:          client.getID(),
+			Default:     client == r.defaultClient,
+			ImagePrefix: client.imageName(""),
+			IdPrefix:    client.augmentId(""),
+			Endpoint:    client.getAddr(),
+			State:       client.currentState().String(),
+		}
+		if r.health != nil {
+			r.health.Lock()
+			if rh := r.health.health[client.getID()]; rh != nil {
+				healthy := rh.err == nil
+				checkedAt := rh.checkedAt
+				info.Healthy = &healthy
+				info.LastHealthCheck = &checkedAt
+				if rh.err != nil {
+					info.HealthError = rh.err.Error()
+				}
+			}
+			r.health.Unlock()
+		}
+		backends = append(backends, info)
+	}
+	return backends
+}
@@ -89,6 +89,7 @@ func (o *Image_112) RepoTags() []string                  { return o.inner.RepoTa
 func (o *Image_112) SetRepoTags(repoTags []string)       { o.inner.RepoTags = repoTags }
 func (o *Image_112) RepoDigests() []string               { return o.inner.RepoDigests }
 func (o *Image_112) SetRepoDigests(repoDigests []string) { o.inner.RepoDigests = repoDigests }
+func (o *Image_112) Size() uint64                        { return o.inner.Size_ }
 
 // ---
 
@@ -177,6 +178,7 @@ func (o *FilesystemUsage_112) Wrap(v interface{}) {
 	}
 }
 func (o *FilesystemUsage_112) Unwrap() interface{} { return o.inner }
+func (o *FilesystemUsage_112) FsId() string        { return o.inner.FsId.GetMountpoint() }
 
 // ---
 
@@ -210,7 +212,12 @@ func (o *VersionResponse_112) Wrap(v interface{}) {
 		o.inner = v.(*runtimeapi.VersionResponse)
 	}
 }
-func (o *VersionResponse_112) Unwrap() interface{} { return o.inner }
+func (o *VersionResponse_112) Unwrap() interface{}              { return o.inner }
+func (o *VersionResponse_112) SetRuntimeName(name string)       { o.inner.RuntimeName = name }
+func (o *VersionResponse_112) SetRuntimeVersion(version string) { o.inner.RuntimeVersion = version }
+func (o *VersionResponse_112) SetRuntimeApiVersion(version string) {
+	o.inner.RuntimeApiVersion = version
+}
 
 // ---
 
@@ -299,6 +306,12 @@ func (o *RunPodSandboxRequest_112) Unwrap() interface{} { return o.inner }
 func (o *RunPodSandboxRequest_112) GetAnnotations() map[string]string {
 	return o.inner.Config.GetAnnotations()
 }
+func (o *RunPodSandboxRequest_112) PodUid() string {
+	return o.inner.Config.GetMetadata().GetUid()
+}
+func (o *RunPodSandboxRequest_112) RuntimeHandler() string {
+	return o.inner.RuntimeHandler
+}
 
 // ---
 
@@ -522,6 +535,10 @@ func (o *CreateContainerRequest_112) SetImage(image string) {
 	}
 }
 
+func (o *CreateContainerRequest_112) PodUid() string {
+	return o.inner.SandboxConfig.GetMetadata().GetUid()
+}
+
 // ---
 
 type CreateContainerResponse_112 struct {
@@ -1185,6 +1202,20 @@ func (o *PullImageRequest_112) Image() string       { return o.inner.Image.GetIm
 func (o *PullImageRequest_112) SetImage(image string) {
 	o.inner.Image = &runtimeapi.ImageSpec{Image: image}
 }
+func (o *PullImageRequest_112) PodUid() string {
+	return o.inner.SandboxConfig.GetMetadata().GetUid()
+}
+func (o *PullImageRequest_112) HasAuth() bool { return o.inner.Auth != nil }
+func (o *PullImageRequest_112) SetAuth(auth *RegistryAuth) {
+	o.inner.Auth = &runtimeapi.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		Auth:          auth.Auth,
+		ServerAddress: auth.ServerAddress,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+	}
+}
 
 // ---
 
@@ -1410,6 +1441,14 @@ func (c *CRI112) ProbeRequest() (interface{}, interface{}) {
 	return &runtimeapi.VersionRequest{}, &runtimeapi.VersionResponse{}
 }
 
+func (c *CRI112) StatusRequest() interface{} {
+	return &runtimeapi.StatusRequest{}
+}
+
+func (c *CRI112) ImageStatusRequest(image string) interface{} {
+	return &runtimeapi.ImageStatusRequest{Image: &runtimeapi.ImageSpec{Image: image}}
+}
+
 func (c *CRI112) WrapObject(o interface{}) (CRIObject, CRIObject, error) {
 	return wrapUsingMatcher(cri112typeMatcher, o)
 }
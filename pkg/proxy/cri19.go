@@ -89,6 +89,7 @@ func (o *Image_19) RepoTags() []string                  { return o.inner.RepoTag
 func (o *Image_19) SetRepoTags(repoTags []string)       { o.inner.RepoTags = repoTags }
 func (o *Image_19) RepoDigests() []string               { return o.inner.RepoDigests }
 func (o *Image_19) SetRepoDigests(repoDigests []string) { o.inner.RepoDigests = repoDigests }
+func (o *Image_19) Size() uint64                        { return o.inner.Size_ }
 
 // ---
 
@@ -174,6 +175,7 @@ func (o *FilesystemUsage_19) Wrap(v interface{}) {
 	}
 }
 func (o *FilesystemUsage_19) Unwrap() interface{} { return o.inner }
+func (o *FilesystemUsage_19) FsId() string        { return o.inner.StorageId.GetUuid() }
 
 // ---
 
@@ -207,7 +209,12 @@ func (o *VersionResponse_19) Wrap(v interface{}) {
 		o.inner = v.(*runtimeapi.VersionResponse)
 	}
 }
-func (o *VersionResponse_19) Unwrap() interface{} { return o.inner }
+func (o *VersionResponse_19) Unwrap() interface{}              { return o.inner }
+func (o *VersionResponse_19) SetRuntimeName(name string)       { o.inner.RuntimeName = name }
+func (o *VersionResponse_19) SetRuntimeVersion(version string) { o.inner.RuntimeVersion = version }
+func (o *VersionResponse_19) SetRuntimeApiVersion(version string) {
+	o.inner.RuntimeApiVersion = version
+}
 
 // ---
 
@@ -296,6 +303,13 @@ func (o *RunPodSandboxRequest_19) Unwrap() interface{} { return o.inner }
 func (o *RunPodSandboxRequest_19) GetAnnotations() map[string]string {
 	return o.inner.Config.GetAnnotations()
 }
+func (o *RunPodSandboxRequest_19) PodUid() string {
+	return o.inner.Config.GetMetadata().GetUid()
+}
+func (o *RunPodSandboxRequest_19) RuntimeHandler() string {
+	// runtime handlers are not supported by CRI 1.9
+	return ""
+}
 
 // ---
 
@@ -519,6 +533,10 @@ func (o *CreateContainerRequest_19) SetImage(image string) {
 	}
 }
 
+func (o *CreateContainerRequest_19) PodUid() string {
+	return o.inner.SandboxConfig.GetMetadata().GetUid()
+}
+
 // ---
 
 type CreateContainerResponse_19 struct {
@@ -1156,6 +1174,20 @@ func (o *PullImageRequest_19) Image() string       { return o.inner.Image.GetIma
 func (o *PullImageRequest_19) SetImage(image string) {
 	o.inner.Image = &runtimeapi.ImageSpec{Image: image}
 }
+func (o *PullImageRequest_19) PodUid() string {
+	return o.inner.SandboxConfig.GetMetadata().GetUid()
+}
+func (o *PullImageRequest_19) HasAuth() bool { return o.inner.Auth != nil }
+func (o *PullImageRequest_19) SetAuth(auth *RegistryAuth) {
+	o.inner.Auth = &runtimeapi.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		Auth:          auth.Auth,
+		ServerAddress: auth.ServerAddress,
+		IdentityToken: auth.IdentityToken,
+		RegistryToken: auth.RegistryToken,
+	}
+}
 
 // ---
 
@@ -1379,6 +1411,14 @@ func (c *CRI19) ProbeRequest() (interface{}, interface{}) {
 	return &runtimeapi.VersionRequest{}, &runtimeapi.VersionResponse{}
 }
 
+func (c *CRI19) StatusRequest() interface{} {
+	return &runtimeapi.StatusRequest{}
+}
+
+func (c *CRI19) ImageStatusRequest(image string) interface{} {
+	return &runtimeapi.ImageStatusRequest{Image: &runtimeapi.ImageSpec{Image: image}}
+}
+
 func (c *CRI19) WrapObject(o interface{}) (CRIObject, CRIObject, error) {
 	return wrapUsingMatcher(cri19typeMatcher, o)
 }
@@ -77,6 +77,23 @@ type ImageObject interface {
 	SetImage(string)
 }
 
+// PodUidObject is a wrapped CRI object that contains a pod UID.
+type PodUidObject interface {
+	// PodUid returns the UID of the pod the object belongs to.
+	PodUid() string
+}
+
+// RegistryAuth denotes image registry credentials. It's
+// independent of CRI version.
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	ServerAddress string `json:"serverAddress,omitempty"`
+	IdentityToken string `json:"identityToken,omitempty"`
+	RegistryToken string `json:"registryToken,omitempty"`
+}
+
 // IdFilterObject is a wrapped CRI object that denotes a filter that uses an id.
 type IdFilterObject interface {
 	// IdFilter returns the id used by the filter.
@@ -149,6 +166,7 @@ type Image interface {
 	SetRepoTags([]string)
 	RepoDigests() []string
 	SetRepoDigests([]string)
+	Size() uint64
 }
 
 // PodSandboxStatus wraps a CRI PodSandboxStatus object
@@ -169,6 +187,9 @@ type ContainerStatus interface {
 // FilesystemUsage wraps a CRI FilesystemUsage object
 type FilesystemUsage interface {
 	CRIObject
+	// FsId returns the identifier of the filesystem (storage uuid
+	// for CRI 1.9, mountpoint for CRI 1.12).
+	FsId() string
 }
 
 // VersionRequest wraps a CRI VersionRequest object
@@ -179,6 +200,9 @@ type VersionRequest interface {
 // VersionResponse wraps a CRI VersionResponse object
 type VersionResponse interface {
 	CRIObject
+	SetRuntimeName(string)
+	SetRuntimeVersion(string)
+	SetRuntimeApiVersion(string)
 }
 
 // StatusRequest wraps a CRI StatusRequest object
@@ -205,6 +229,8 @@ type UpdateRuntimeConfigResponse interface {
 type RunPodSandboxRequest interface {
 	CRIObject
 	GetAnnotations() map[string]string
+	PodUidObject
+	RuntimeHandler() string
 }
 
 // RunPodSandboxResponse wraps a CRI RunPodSandboxResponse object
@@ -264,6 +290,7 @@ type CreateContainerRequest interface {
 	CRIObject
 	PodSandboxIdObject
 	ImageObject
+	PodUidObject
 }
 
 // CreateContainerResponse wraps a CRI CreateContainerResponse object
@@ -453,6 +480,11 @@ type ImageStatusResponse interface {
 type PullImageRequest interface {
 	CRIObject
 	ImageObject
+	PodUidObject
+	// HasAuth returns true if the request contains registry credentials.
+	HasAuth() bool
+	// SetAuth sets the registry credentials for the request.
+	SetAuth(auth *RegistryAuth)
 }
 
 // PullImageResponse wraps a CRI PullImageResponse object
@@ -491,6 +523,12 @@ type CRIVersion interface {
 	// that can be used to check the server availability and
 	// compatibility with this CRI version.
 	ProbeRequest() (interface{}, interface{})
+	// StatusRequest returns raw CRI Status request that's used
+	// for runtime health checks.
+	StatusRequest() interface{}
+	// ImageStatusRequest returns raw CRI ImageStatus request for
+	// the specified image.
+	ImageStatusRequest(image string) interface{}
 	// WrapObject wraps a raw CRI object and returns the wrapped
 	// source object, and, in case if the object is a Request,
 	// also an empty Response object that matches it
@@ -22,6 +22,7 @@ import (
 	"os"
 	"syscall"
 
+	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
@@ -42,17 +43,22 @@ type Interceptor interface {
 type Server struct {
 	server       *grpc.Server
 	interceptors []Interceptor
+	socketMode   os.FileMode
+	socketGid    int
+	allowedUids  map[uint32]bool
 }
 
-// NewServer makes a new gRPC server.
-func NewServer(interceptors []Interceptor, hook func()) *Server {
-	s := &Server{interceptors: interceptors}
-	s.server = grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+// NewServer makes a new gRPC server. Extra options may be passed
+// to the underlying gRPC server via opts.
+func NewServer(interceptors []Interceptor, hook func(), opts ...grpc.ServerOption) *Server {
+	s := &Server{interceptors: interceptors, socketGid: -1}
+	opts = append(opts, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
 		if hook != nil {
 			hook()
 		}
 		return s.intercept(ctx, req, info, handler)
 	}))
+	s.server = grpc.NewServer(opts...)
 	for _, intc := range s.interceptors {
 		intc.Register(s.server)
 	}
@@ -68,6 +74,55 @@ func (s *Server) intercept(ctx context.Context, req interface{}, info *grpc.Unar
 	return nil, fmt.Errorf("no interceptor for method %q", info.FullMethod)
 }
 
+// SetSocketPermissions makes the server set the specified file
+// mode and owning group on its socket. Zero mode means that the
+// mode is not changed, and so does a negative gid for the group.
+func (s *Server) SetSocketPermissions(mode os.FileMode, gid int) {
+	s.socketMode = mode
+	s.socketGid = gid
+}
+
+// SetAllowedUids makes the server only accept the connections from
+// the processes with the specified uids, which are checked using
+// SO_PEERCRED. If uids is empty, connections from any processes
+// are accepted.
+func (s *Server) SetAllowedUids(uids []uint32) {
+	s.allowedUids = nil
+	if len(uids) == 0 {
+		return
+	}
+	s.allowedUids = make(map[uint32]bool)
+	for _, uid := range uids {
+		s.allowedUids[uid] = true
+	}
+}
+
+// credListener is a net.Listener that rejects the connections from
+// the processes with uids that are not allowed
+type credListener struct {
+	net.Listener
+	allowedUids map[uint32]bool
+}
+
+func (l *credListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, err := peerUid(conn)
+		switch {
+		case err != nil:
+			glog.Warningf("Rejected connection: can't get peer credentials: %v", err)
+		case !l.allowedUids[uid]:
+			glog.Warningf("Rejected connection from uid %d", uid)
+		default:
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
 // Serve makes the server listen on the specified addr. If readyCh is
 // not nil, it'll be closed when the server is ready to accept
 // connections.
@@ -80,6 +135,19 @@ func (s *Server) Serve(addr string, readyCh chan struct{}) error {
 		return err
 	}
 	defer ln.Close()
+	if s.socketMode != 0 {
+		if err := os.Chmod(addr, s.socketMode); err != nil {
+			return err
+		}
+	}
+	if s.socketGid >= 0 {
+		if err := os.Chown(addr, -1, s.socketGid); err != nil {
+			return err
+		}
+	}
+	if s.allowedUids != nil {
+		ln = &credListener{Listener: ln, allowedUids: s.allowedUids}
+	}
 	if readyCh != nil {
 		close(readyCh)
 	}
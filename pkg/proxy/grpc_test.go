@@ -0,0 +1,115 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mirantis/criproxy/pkg/utils"
+)
+
+func TestSocketPermissions(t *testing.T) {
+	server := NewServer(nil, nil)
+	defer server.Stop()
+	server.SetSocketPermissions(0640, os.Getgid())
+	startServer(t, server, criProxySocketForTests)
+
+	fi, err := os.Stat(criProxySocketForTests)
+	if err != nil {
+		t.Fatalf("Stat(): %v", err)
+	}
+	if mode := fi.Mode().Perm(); mode != 0640 {
+		t.Errorf("bad socket mode %04o instead of 0640", mode)
+	}
+}
+
+func TestPeerCredentials(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		allowedUids []uint32
+		expectError bool
+	}{
+		{
+			name: "no uid restrictions",
+		},
+		{
+			name:        "allowed uid",
+			allowedUids: []uint32{uint32(os.Getuid())},
+		},
+		{
+			name:        "uid not allowed",
+			allowedUids: []uint32{uint32(os.Getuid()) + 4242},
+			expectError: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(nil, nil)
+			defer server.Stop()
+			server.SetAllowedUids(tc.allowedUids)
+			startServer(t, server, criProxySocketForTests)
+
+			// the rejected connections are accepted by the
+			// kernel and then closed by the server, so check
+			// whether reading from the connection hits EOF
+			conn, err := utils.Dial(criProxySocketForTests, time.Second)
+			if err != nil {
+				t.Fatalf("Dial(): %v", err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+			_, err = conn.Read(make([]byte, 1))
+			switch {
+			case tc.expectError && err != io.EOF:
+				t.Errorf("the connection wasn't rejected (read error: %v)", err)
+			case !tc.expectError && err == io.EOF:
+				t.Errorf("the connection was rejected")
+			}
+		})
+	}
+}
+
+func TestServeKeepsOtherSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "criproxy-sockets")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a socket nothing listens on, which is only removed
+	// with -cleanupSockets
+	orphaned := filepath.Join(dir, "criproxy-old.sock")
+	orphanedLn, err := net.Listen("unix", orphaned)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	orphanedLn.(*net.UnixListener).SetUnlinkOnClose(false)
+	orphanedLn.Close()
+
+	server := NewServer(nil, nil)
+	defer server.Stop()
+	startServer(t, server, filepath.Join(dir, "criproxy.sock"))
+
+	if _, err := os.Lstat(orphaned); err != nil {
+		t.Errorf("the socket was removed by Serve(): %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+const statusRequestMethod = "RuntimeService/Status"
+
+// runtimeHealth denotes the result of the last health check
+// of a runtime
+type runtimeHealth struct {
+	err       error
+	status    CRIObject
+	checkedAt time.Time
+}
+
+// healthChecker keeps the results of runtime health checks
+type healthChecker struct {
+	sync.Mutex
+	interval      time.Duration
+	retryInterval time.Duration
+	health        map[string]*runtimeHealth
+	startOnce     sync.Once
+	stopCh        chan struct{}
+}
+
+func newHealthChecker(interval, retryInterval time.Duration) *healthChecker {
+	if retryInterval <= 0 || retryInterval > interval {
+		retryInterval = interval
+	}
+	return &healthChecker{
+		interval:      interval,
+		retryInterval: retryInterval,
+		health:        make(map[string]*runtimeHealth),
+		stopCh:        make(chan struct{}),
+	}
+}
+
+func (h *healthChecker) set(id string, err error, status CRIObject) {
+	h.Lock()
+	defer h.Unlock()
+	h.health[id] = &runtimeHealth{err: err, status: status, checkedAt: time.Now()}
+}
+
+// cachedStatus returns the cached Status response of the runtime
+// or nil if the runtime is unhealthy or the cached response is
+// older than twice the check interval
+func (h *healthChecker) cachedStatus(id string) CRIObject {
+	h.Lock()
+	defer h.Unlock()
+	rh := h.health[id]
+	if rh == nil || rh.err != nil || time.Since(rh.checkedAt) > 2*h.interval {
+		return nil
+	}
+	return rh.status
+}
+
+// startHealthChecks starts checking the health of the runtimes in the
+// background. The checks are started upon the first request so that
+// only the proxy for CRI version that's actually used by kubelet makes
+// them.
+func (r *RuntimeProxy) startHealthChecks() {
+	if r.health == nil {
+		return
+	}
+	r.health.startOnce.Do(func() {
+		for _, client := range r.clients {
+			go r.healthCheckLoop(client)
+		}
+	})
+}
+
+func (r *RuntimeProxy) stopHealthChecks() {
+	if r.health != nil {
+		close(r.health.stopCh)
+	}
+}
+
+func (r *RuntimeProxy) healthCheckLoop(client client) {
+	for {
+		interval := r.health.interval
+		if err := r.checkHealth(client); err != nil {
+			// recheck unhealthy runtimes sooner
+			interval = r.health.retryInterval
+		}
+		select {
+		case <-r.health.stopCh:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// checkHealth checks the health of the runtime using Status request
+// and records the result
+func (r *RuntimeProxy) checkHealth(client client) error {
+	var resp CRIObject
+	var err error
+	if client.currentState() != clientStateConnected {
+		// trigger reconnection
+		client.connect()
+		err = errNotConnected
+	} else {
+		var req CRIObject
+		req, resp, err = r.criVersion.WrapObject(r.criVersion.StatusRequest())
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), r.health.interval)
+			_, err = client.invokeWithErrorHandling(ctx, r.methodPrefix+statusRequestMethod, req, resp)
+			cancel()
+		}
+	}
+	r.health.set(client.getID(), err, resp)
+	if err != nil {
+		glog.Warningf("Health check failed for runtime %q: %v", client.getID(), err)
+		runtimeHealthy.WithLabelValues(runtimeLabel(client)).Set(0)
+	} else {
+		runtimeHealthy.WithLabelValues(runtimeLabel(client)).Set(1)
+	}
+	return err
+}
+
+// RuntimeHealth returns the results of the latest health checks
+// of the runtimes, keyed by runtime id. It returns nil if the
+// health checks are disabled or haven't been done yet.
+func (r *RuntimeProxy) RuntimeHealth() map[string]error {
+	if r.health == nil {
+		return nil
+	}
+	r.health.Lock()
+	defer r.health.Unlock()
+	if len(r.health.health) == 0 {
+		return nil
+	}
+	result := make(map[string]error)
+	for id, rh := range r.health.health {
+		result[id] = rh.err
+	}
+	return result
+}
+
+// status returns the cached Status response of the primary runtime if
+// it's fresh enough, otherwise passes the request to the runtime
+func (r *RuntimeProxy) status(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
+	if r.health != nil {
+		if status := r.health.cachedStatus(r.clients[0].getID()); status != nil {
+			return status, nil
+		}
+	}
+	return r.passToPrimary(ctx, method, req, resp)
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/Mirantis/criproxy/pkg/version"
+)
+
+const (
+	metricsNamespace   = "criproxy"
+	primaryRuntimeName = "primary"
+	defaultRegistry    = "docker.io"
+)
+
+var (
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "build_info",
+		Help:      "Always 1, labeled by the version and the git commit of CRI Proxy.",
+	}, []string{"version", "commit"})
+	startTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "start_time_seconds",
+		Help:      "Start time of CRI Proxy since unix epoch in seconds.",
+	})
+	imagePullsWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_pulls_waiting",
+		Help:      "Number of PullImage requests waiting for other pulls to finish.",
+	}, []string{"runtime"})
+	runtimeHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "runtime_healthy",
+		Help:      "Whether the last health check of the runtime succeeded (1) or not (0).",
+	}, []string{"runtime"})
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected because of the rate limits.",
+	}, []string{"runtime", "method"})
+	observedRoutes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "observed_routes_total",
+		Help:      "Number of requests passed to the runtimes in the observe mode, labeled by the runtime the request would be routed to.",
+	}, []string{"method", "actual", "would_route"})
+	imagePullDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "image_pull_duration_seconds",
+		Help:      "Time taken by the runtimes to pull the images.",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"runtime", "registry"})
+	pulledImageSize = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Namespace:  metricsNamespace,
+		Name:       "pulled_image_size_bytes",
+		Help:       "Sizes of the pulled images as reported by ImageStatus.",
+		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	}, []string{"runtime", "registry"})
+)
+
+func init() {
+	prometheus.MustRegister(buildInfo)
+	prometheus.MustRegister(startTime)
+	prometheus.MustRegister(imagePullsWaiting)
+	prometheus.MustRegister(runtimeHealthy)
+	prometheus.MustRegister(rateLimitedRequests)
+	prometheus.MustRegister(observedRoutes)
+	prometheus.MustRegister(imagePullDuration)
+	prometheus.MustRegister(pulledImageSize)
+
+	buildInfo.WithLabelValues(version.Version, version.Commit).Set(1)
+	startTime.Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+// runtimeLabel returns the value of 'runtime' label of the metrics
+// for the specified client.
+func runtimeLabel(c client) string {
+	if c.isPrimary() {
+		return primaryRuntimeName
+	}
+	return c.getID()
+}
+
+// registryLabel returns the value of 'registry' label of the metrics
+// for the specified image name without runtime prefix.
+func registryLabel(image string) string {
+	n := strings.Index(image, "/")
+	if n < 0 {
+		return defaultRegistry
+	}
+	host := image[:n]
+	if host != "localhost" && !strings.ContainsAny(host, ".:") {
+		return defaultRegistry
+	}
+	return host
+}
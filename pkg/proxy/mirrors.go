@@ -0,0 +1,134 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+type registryMirror struct {
+	prefix, mirror string
+}
+
+// registryMirrors rewrites the image names passed to the runtimes to
+// use registry mirrors and restores the original names in the
+// responses
+type registryMirrors []registryMirror
+
+// newRegistryMirrors makes registryMirrors from the map of image name
+// prefixes to mirrors. It returns an error if the mirrored names can't
+// be mapped back unambiguously, i.e. if a mirror is the same as
+// another one or is nested under it.
+func newRegistryMirrors(mirrors map[string]string) (registryMirrors, error) {
+	var r registryMirrors
+	for prefix, mirror := range mirrors {
+		prefix = strings.TrimSuffix(prefix, "/")
+		mirror = strings.TrimSuffix(mirror, "/")
+		if prefix == "" || mirror == "" {
+			return nil, fmt.Errorf("bad registry mirror %q -> %q", prefix, mirror)
+		}
+		r = append(r, registryMirror{prefix, mirror})
+	}
+	for _, a := range r {
+		for _, b := range r {
+			if a.prefix != b.prefix && (a.mirror == b.mirror || strings.HasPrefix(a.mirror, b.mirror+"/")) {
+				return nil, fmt.Errorf("registry mirror %q for %q clashes with mirror %q for %q", a.mirror, a.prefix, b.mirror, b.prefix)
+			}
+		}
+	}
+	// make the longest prefixes match first
+	sort.Slice(r, func(i, j int) bool {
+		return len(r[i].prefix) > len(r[j].prefix)
+	})
+	return r, nil
+}
+
+// replacePrefix replaces the prefix of the image name if the name
+// starts with it followed by a slash
+func replacePrefix(image, from, to string) (string, bool) {
+	if !strings.HasPrefix(image, from+"/") {
+		return image, false
+	}
+	return to + image[len(from):], true
+}
+
+// rewrite returns the name of the image to be pulled from the mirror
+func (m registryMirrors) rewrite(image string) string {
+	for _, item := range m {
+		if r, ok := replacePrefix(image, item.prefix, item.mirror); ok {
+			return r
+		}
+	}
+	return image
+}
+
+// restore returns the original name of the image pulled from
+// the mirror
+func (m registryMirrors) restore(image string) string {
+	for _, item := range m {
+		if r, ok := replacePrefix(image, item.mirror, item.prefix); ok {
+			return r
+		}
+	}
+	return image
+}
+
+// restoreImage returns the image with the original names in place of
+// the mirrored ones
+func (m registryMirrors) restoreImage(unrestoredImage Image) Image {
+	if len(m) == 0 {
+		return unrestoredImage
+	}
+	image := unrestoredImage.Copy()
+	// image ids that are digests don't contain the image name
+	if _, err := digest.Parse(image.Id()); err != nil {
+		image.SetId(m.restore(image.Id()))
+	}
+	repoTags := make([]string, len(image.RepoTags()))
+	for n, tag := range image.RepoTags() {
+		repoTags[n] = m.restore(tag)
+	}
+	image.SetRepoTags(repoTags)
+	repoDigests := make([]string, len(image.RepoDigests()))
+	for n, digest := range image.RepoDigests() {
+		repoDigests[n] = m.restore(digest)
+	}
+	image.SetRepoDigests(repoDigests)
+	return image
+}
+
+// restoreObject restores the original image names in the images and
+// containers returned by the runtimes
+func (m registryMirrors) restoreObject(criObject CRIObject) CRIObject {
+	if len(m) == 0 {
+		return criObject
+	}
+	switch o := criObject.(type) {
+	case Image:
+		return m.restoreImage(o)
+	case Container:
+		container := o.Copy()
+		container.SetImage(m.restore(o.Image()))
+		return container
+	default:
+		return o
+	}
+}
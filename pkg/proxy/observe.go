@@ -0,0 +1,69 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// observedRoute returns the id of the runtime the request would be
+// passed to if the routing was enabled. It returns false if the
+// routing doesn't depend on the request contents in the observe mode,
+// e.g. for List requests or for the requests containing the object
+// ids that all come from the primary runtime in this mode.
+func (r *RuntimeProxy) observedRoute(req CRIObject) (string, bool) {
+	switch in := req.(type) {
+	case RunPodSandboxRequest:
+		if client, found := r.handlerClients[in.RuntimeHandler()]; found && in.RuntimeHandler() != "" {
+			return client.getID(), true
+		}
+		for _, client := range r.clients {
+			if client.annotationsMatch(in.GetAnnotations()) {
+				return client.getID(), true
+			}
+		}
+		// the runtime isn't among the ones to connect to
+		return in.GetAnnotations()[targetRuntimeAnnotationKey], true
+	case ImageObject:
+		client, _, err := r.routeImage(in.Image())
+		if err != nil {
+			// the request would be rejected
+			return "", false
+		}
+		return client.getID(), true
+	}
+	return "", false
+}
+
+// observe passes the request to the primary runtime unchanged,
+// logging the routing decision that would be made for it otherwise
+func (r *RuntimeProxy) observe(ctx context.Context, method, fullMethod string, req, resp CRIObject) (interface{}, error) {
+	if id, ok := r.observedRoute(req); ok {
+		wouldRoute := primaryRuntimeName
+		if id != "" {
+			wouldRoute = id
+		}
+		observedRoutes.WithLabelValues(method, primaryRuntimeName, wouldRoute).Inc()
+		if id != "" {
+			glog.Infof("OBSERVE: %s() passed to the primary runtime would be routed to runtime %q", fullMethod, id)
+		} else if glog.V(criRequestLogLevel) {
+			glog.Infof("OBSERVE: %s() would be routed to the primary runtime, too", fullMethod)
+		}
+	}
+	return r.passToPrimary(ctx, fullMethod, req, resp)
+}
@@ -19,6 +19,7 @@ package proxy
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/url"
 	"regexp"
 	"strings"
@@ -28,22 +29,187 @@ import (
 	"github.com/golang/glog"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/Mirantis/criproxy/pkg/utils"
+	"github.com/Mirantis/criproxy/pkg/version"
 )
 
 const (
+	defaultRuntimeName = "criproxy"
 	criErrorLogLevel   = 2
 	criRequestLogLevel = 3
 	criNoisyLogLevel   = 4
 	criListLogLevel    = 5
+	imageServicePrefix = "ImageService/"
 )
 
+// RuntimeProxyOptions denotes optional settings of RuntimeProxy.
+type RuntimeProxyOptions struct {
+	// DefaultRuntime is the id of the runtime that handles the
+	// images that don't have a runtime prefix. If it's empty,
+	// such images are handled by the primary runtime. If it
+	// names another runtime, the images of the primary runtime
+	// get "primary/" prefix.
+	DefaultRuntime string
+	// NoDefaultRuntime makes the proxy reject the images that
+	// don't have a runtime prefix with InvalidArgument error.
+	// The images of the primary runtime get "primary/" prefix
+	// in this case.
+	NoDefaultRuntime bool
+	// KeepaliveTime is the interval between the pings the proxy
+	// makes to check whether the runtime connections are still
+	// alive. The pings are Version requests, so they're made
+	// regardless of whether the connection is idle. Zero value
+	// disables the keepalive pings.
+	KeepaliveTime time.Duration
+	// KeepaliveTimeout is the time the proxy waits for a response
+	// to a keepalive ping before closing the connection and
+	// reconnecting to the runtime. Zero value means the
+	// connection timeout.
+	KeepaliveTimeout time.Duration
+	// MaxParallelImagePulls limits the number of PullImage
+	// requests that are passed to each runtime at the same time.
+	// The remaining requests wait for their turn. Zero value
+	// means no limit.
+	MaxParallelImagePulls int
+	// AllowedMethods lists the CRI methods that the proxy
+	// handles, e.g. "RunPodSandbox" or "RuntimeService/ExecSync".
+	// If it's empty, all of the methods are allowed except for
+	// DeniedMethods.
+	AllowedMethods []string
+	// DeniedMethods lists the CRI methods that the proxy rejects
+	// with Unimplemented error.
+	DeniedMethods []string
+	// NoImageService makes the proxy reject all of the ImageService
+	// methods, for use with a separate image endpoint in kubelet
+	// (--image-service-endpoint).
+	NoImageService bool
+	// RuntimeHandlers maps RuntimeClass handler names to the ids
+	// of the runtimes that handle them, with an empty id denoting
+	// the primary runtime. The pods with runtime handlers that are
+	// not listed here are routed using target runtime annotation.
+	RuntimeHandlers map[string]string
+	// RuntimeApiVersion overrides the CRI API version that's
+	// reported to kubelet by Version call. If it's empty, the
+	// version reported by the primary runtime is used.
+	RuntimeApiVersion string
+	// RuntimeName is the runtime name that's reported to kubelet
+	// by Version call. If it's empty, "criproxy" is used.
+	RuntimeName string
+	// RegistryAuth maps runtime ids to the registry credentials
+	// that are passed to the runtime in PullImage requests that
+	// don't contain credentials. Empty id denotes the primary runtime.
+	RegistryAuth map[string]*RegistryAuth
+	// MaxMessageSize is the max size of gRPC messages received
+	// by the proxy on its own socket. The pinned gRPC version
+	// doesn't limit the size of the messages sent by the proxy
+	// and of the responses it receives from the runtimes. Zero
+	// means gRPC default of 4 MiB.
+	MaxMessageSize int
+	// HealthCheckInterval is the interval between the health
+	// checks of the runtimes. The Status requests are served
+	// from the cached results of the health checks. Zero value
+	// disables the health checks.
+	HealthCheckInterval time.Duration
+	// HealthCheckRetryInterval is the interval between the health
+	// checks of the runtimes that are unhealthy.
+	HealthCheckRetryInterval time.Duration
+	// BackendTLS maps the ids of the runtimes that are connected
+	// to over TCP to their TLS settings. Empty id denotes the
+	// primary runtime.
+	BackendTLS map[string]*BackendTLS
+	// RateLimits maps CRI method names, which may be specified
+	// with or without the service name, to the rate limits that
+	// are applied to each runtime separately.
+	RateLimits map[string]RateLimit
+	// RegistryMirrors maps image name prefixes such as docker.io
+	// to registry mirrors, e.g. mirror.example.com:5000. The
+	// image names are rewritten to use the mirrors in the requests
+	// passed to the runtimes, with the original names reported back
+	// to kubelet. Each mirror must map back to a single prefix.
+	RegistryMirrors map[string]string
+	// PullImageSizeMetrics makes the proxy request the status of
+	// each image after pulling it to record the image size
+	PullImageSizeMetrics bool
+	// Observe makes the proxy pass all of the requests to the
+	// primary runtime unchanged, only logging the routing
+	// decisions that would be made for them otherwise
+	Observe bool
+}
+
+// LoadRegistryAuth loads a YAML or JSON file that maps runtime ids to
+// the registry credentials to be used for the runtimes.
+func LoadRegistryAuth(path string) (map[string]*RegistryAuth, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var auth map[string]*RegistryAuth
+	if err := yaml.Unmarshal(data, &auth); err != nil {
+		return nil, fmt.Errorf("error parsing %q: %v", path, err)
+	}
+	return auth, nil
+}
+
+// keepaliveParams holds the settings of the keepalive pings
+// of a runtime connection
+type keepaliveParams struct {
+	time, timeout time.Duration
+}
+
+// keepaliveParams returns the keepalive settings of the runtime
+// connections, with zero time if the keepalive pings are disabled.
+func (opts RuntimeProxyOptions) keepaliveParams() keepaliveParams {
+	if opts.KeepaliveTime <= 0 {
+		return keepaliveParams{}
+	}
+	return keepaliveParams{time: opts.KeepaliveTime, timeout: opts.KeepaliveTimeout}
+}
+
+// ServerOptions returns the options to be used for the proxy's
+// gRPC server.
+func (opts RuntimeProxyOptions) ServerOptions() []grpc.ServerOption {
+	if opts.MaxMessageSize <= 0 {
+		return nil
+	}
+	return []grpc.ServerOption{grpc.MaxMsgSize(opts.MaxMessageSize)}
+}
+
 // RuntimeProxy is a gRPC implementation of internalapi.RuntimeService.
 type RuntimeProxy struct {
-	criVersion   CRIVersion
-	streamUrl    url.URL
-	conn         *grpc.ClientConn
-	clients      []client
-	methodPrefix string
+	criVersion    CRIVersion
+	streamUrl     url.URL
+	conn          *grpc.ClientConn
+	clients       []client
+	defaultClient client
+	methodPrefix  string
+	// pullSemaphores limit the number of parallel image pulls per runtime id
+	pullSemaphores map[string]chan struct{}
+	// pulls coalesces concurrent pulls of the same image
+	pulls pullGroup
+	// registryAuth maps runtime ids to their default registry credentials
+	registryAuth map[string]*RegistryAuth
+	// health is used for runtime health checks if they're enabled
+	health *healthChecker
+	// mirrors rewrite the image names passed to the runtimes
+	mirrors registryMirrors
+	// pullImageSizeMetrics enables recording the sizes of the
+	// pulled images
+	pullImageSizeMetrics bool
+	// observeOnly makes the proxy pass all of the requests to the
+	// primary runtime (see RuntimeProxyOptions.Observe)
+	observeOnly bool
+	// deniedMethods contains dispatch table keys of the methods
+	// that are rejected by the proxy
+	deniedMethods map[string]bool
+	// handlerClients maps runtime handler names to the clients
+	handlerClients map[string]client
+	// runtimeApiVersion overrides the CRI API version reported by Version
+	runtimeApiVersion string
+	// runtimeName is the runtime name reported to kubelet
+	runtimeName string
 }
 
 var _ Interceptor = &RuntimeProxy{}
@@ -56,18 +222,50 @@ type dispatchItem struct {
 }
 
 // NewRuntimeProxy creates a new internalapi.RuntimeService.
-func NewRuntimeProxy(criVersion CRIVersion, addrs []string, connectionTimout time.Duration, streamUrl *url.URL) (*RuntimeProxy, error) {
+func NewRuntimeProxy(criVersion CRIVersion, addrs []string, connectionTimout time.Duration, streamUrl *url.URL, opts RuntimeProxyOptions) (*RuntimeProxy, error) {
 	if len(addrs) == 0 {
 		return nil, errors.New("no sockets specified to connect to")
 	}
+	if opts.RuntimeName == "" {
+		opts.RuntimeName = defaultRuntimeName
+	}
 
 	r := &RuntimeProxy{
-		criVersion:   criVersion,
-		streamUrl:    *streamUrl,
-		methodPrefix: fmt.Sprintf("/%s.", criVersion.ProtoPackage()),
+		criVersion:           criVersion,
+		streamUrl:            *streamUrl,
+		methodPrefix:         fmt.Sprintf("/%s.", criVersion.ProtoPackage()),
+		runtimeApiVersion:    opts.RuntimeApiVersion,
+		runtimeName:          opts.RuntimeName,
+		pullImageSizeMetrics: opts.PullImageSizeMetrics,
+		observeOnly:          opts.Observe,
 	}
+	tlsIds := make(map[string]bool)
 	for _, addr := range addrs {
-		r.clients = append(r.clients, newAutoClient(criVersion, addr, connectionTimout))
+		id, path := ParseRuntimeAddr(addr)
+		var creds credentials.TransportCredentials
+		var err error
+		if backendTLS := opts.BackendTLS[id]; backendTLS != nil {
+			if !utils.IsTCPAddr(path) {
+				return nil, fmt.Errorf("TLS is specified for runtime %q that's not connected to over tcp://", id)
+			}
+			if creds, err = backendTLS.credentials(path); err != nil {
+				return nil, fmt.Errorf("bad TLS settings for runtime %q: %v", id, err)
+			}
+			tlsIds[id] = true
+		} else if utils.IsTCPAddr(path) {
+			glog.Warningf("Connecting to runtime %q at %s without TLS", id, path)
+		}
+		client := newAutoClient(criVersion, addr, connectionTimout, creds)
+		client.keepalive = opts.keepaliveParams()
+		if client.limiters, err = makeRateLimiters(opts.RateLimits); err != nil {
+			return nil, err
+		}
+		r.clients = append(r.clients, client)
+	}
+	for id := range opts.BackendTLS {
+		if !tlsIds[id] {
+			return nil, fmt.Errorf("runtime %q with TLS settings is not among the runtimes to connect to", id)
+		}
 	}
 	if !r.clients[0].isPrimary() {
 		return nil, errors.New("the first client should be primary (no id)")
@@ -78,9 +276,123 @@ func NewRuntimeProxy(criVersion CRIVersion, addrs []string, connectionTimout tim
 		}
 	}
 
+	switch {
+	case opts.NoDefaultRuntime && opts.DefaultRuntime != "":
+		return nil, errors.New("default runtime can't be specified together with no default runtime")
+	case opts.NoDefaultRuntime:
+		r.defaultClient = nil
+	case opts.DefaultRuntime != "":
+		r.defaultClient = r.clientById(opts.DefaultRuntime)
+		if r.defaultClient == nil {
+			return nil, fmt.Errorf("default runtime %q is not among the runtimes to connect to", opts.DefaultRuntime)
+		}
+	default:
+		r.defaultClient = r.clients[0]
+	}
+	if r.defaultClient != r.clients[0] {
+		// the images of the primary runtime can't be left
+		// unprefixed if the primary runtime isn't the default
+		// one, so they get a prefix of their own
+		if r.clientById(primaryRuntimeName) != nil {
+			return nil, fmt.Errorf("runtime id %q is reserved for the images of the primary runtime when it's not the default one", primaryRuntimeName)
+		}
+		r.clients[0].setImagePrefix(primaryRuntimeName)
+	}
+
+	r.handlerClients = make(map[string]client)
+	for handler, id := range opts.RuntimeHandlers {
+		client := r.clientById(id)
+		if client == nil {
+			return nil, fmt.Errorf("runtime %q for runtime handler %q is not among the runtimes to connect to", id, handler)
+		}
+		r.handlerClients[handler] = client
+	}
+
+	for id := range opts.RegistryAuth {
+		if r.clientById(id) == nil {
+			return nil, fmt.Errorf("runtime %q with registry credentials is not among the runtimes to connect to", id)
+		}
+	}
+	r.registryAuth = opts.RegistryAuth
+
+	if err := r.setupMethodFilter(opts.AllowedMethods, opts.DeniedMethods, opts.NoImageService); err != nil {
+		return nil, err
+	}
+
+	mirrors, err := newRegistryMirrors(opts.RegistryMirrors)
+	if err != nil {
+		return nil, err
+	}
+	r.mirrors = mirrors
+
+	if opts.HealthCheckInterval > 0 {
+		r.health = newHealthChecker(opts.HealthCheckInterval, opts.HealthCheckRetryInterval)
+	}
+
+	if opts.MaxParallelImagePulls > 0 {
+		r.pullSemaphores = make(map[string]chan struct{})
+		for _, client := range r.clients {
+			r.pullSemaphores[client.getID()] = make(chan struct{}, opts.MaxParallelImagePulls)
+		}
+	}
+
 	return r, nil
 }
 
+// dispatchTableKey returns the key of dispatch table that
+// corresponds to the specified method name, which may be specified
+// either with or without the service name.
+func dispatchTableKey(method string) (string, error) {
+	if _, found := dispatchTable[method]; found {
+		return method, nil
+	}
+	var key string
+	for k := range dispatchTable {
+		if k[strings.Index(k, "/")+1:] != method {
+			continue
+		}
+		if key != "" {
+			return "", fmt.Errorf("ambiguous CRI method name %q", method)
+		}
+		key = k
+	}
+	if key == "" {
+		return "", fmt.Errorf("unknown CRI method %q", method)
+	}
+	return key, nil
+}
+
+func (r *RuntimeProxy) setupMethodFilter(allowed, denied []string, noImageService bool) error {
+	r.deniedMethods = make(map[string]bool)
+	if len(allowed) != 0 {
+		for k := range dispatchTable {
+			r.deniedMethods[k] = true
+		}
+		for _, method := range allowed {
+			key, err := dispatchTableKey(method)
+			if err != nil {
+				return err
+			}
+			delete(r.deniedMethods, key)
+		}
+	}
+	for _, method := range denied {
+		key, err := dispatchTableKey(method)
+		if err != nil {
+			return err
+		}
+		r.deniedMethods[key] = true
+	}
+	if noImageService {
+		for k := range dispatchTable {
+			if strings.HasPrefix(k, imageServicePrefix) {
+				r.deniedMethods[k] = true
+			}
+		}
+	}
+	return nil
+}
+
 // Register implements Register method of the Interceptor interface.
 func (r *RuntimeProxy) Register(s *grpc.Server) {
 	r.criVersion.Register(s)
@@ -88,11 +400,29 @@ func (r *RuntimeProxy) Register(s *grpc.Server) {
 
 // Stop implements Stop method of the Interceptor interface.
 func (r *RuntimeProxy) Stop() {
+	r.stopHealthChecks()
 	for _, client := range r.clients {
 		client.stop()
 	}
 }
 
+// WaitForRuntimes connects to all of the runtimes and waits until
+// each of them is connected at least once. It returns the first
+// connection error, if any.
+func (r *RuntimeProxy) WaitForRuntimes() error {
+	var errChs []chan error
+	for _, client := range r.clients {
+		errChs = append(errChs, client.connect())
+	}
+	var firstErr error
+	for n, errCh := range errChs {
+		if err := <-errCh; err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error connecting to runtime %q: %v", r.clients[n].getID(), err)
+		}
+	}
+	return firstErr
+}
+
 // Match implements Match method of the Interceptor interface.
 func (r *RuntimeProxy) Match(fullMethod string) bool {
 	lastDot := strings.LastIndex(fullMethod, ".")
@@ -105,10 +435,12 @@ func (r *RuntimeProxy) Match(fullMethod string) bool {
 // Intercept implements Intercept method of the Interceptor interface.
 func (r *RuntimeProxy) Intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
 	var err error
+	ctx, tr := startCallTrace(ctx, info.FullMethod)
 	defer func() {
 		if err != nil {
 			glog.V(criErrorLogLevel).Infof("FAIL: %s(): %v", info.FullMethod, err)
 		}
+		endCallTrace(tr, err)
 	}()
 	if !strings.HasPrefix(info.FullMethod, r.methodPrefix) {
 		err = fmt.Errorf("bad method prefix in %q (expected to start with %q)", info.FullMethod, r.methodPrefix) // make it logged in defer
@@ -116,6 +448,13 @@ func (r *RuntimeProxy) Intercept(ctx context.Context, req interface{}, info *grp
 	}
 
 	method := info.FullMethod[len(r.methodPrefix):]
+	r.startHealthChecks()
+
+	if r.deniedMethods[method] {
+		glog.Warningf("Rejected %s() call: the method is not allowed", info.FullMethod)
+		err = grpc.Errorf(codes.Unimplemented, "criproxy: method %q is not allowed", method) // make it logged in defer
+		return nil, err
+	}
 	dispatchItem, found := dispatchTable[method]
 	if !found {
 		err = fmt.Errorf("no handler for method %q", method) // make it logged in defer
@@ -128,7 +467,13 @@ func (r *RuntimeProxy) Intercept(ctx context.Context, req interface{}, info *grp
 	if err != nil {
 		return nil, err
 	}
-	resp, err := dispatchItem.handler(r, ctx, info.FullMethod, wrappedReq, wrappedResp)
+	setCallTraceAttributes(tr, wrappedReq)
+	var resp interface{}
+	if r.observeOnly {
+		resp, err = r.observe(ctx, method, info.FullMethod, wrappedReq, wrappedResp)
+	} else {
+		resp, err = dispatchItem.handler(r, ctx, info.FullMethod, wrappedReq, wrappedResp)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -148,6 +493,27 @@ func (r *RuntimeProxy) primaryClient() (client, error) {
 	return r.clients[0], nil
 }
 
+// clientById returns the client with the specified runtime id
+// or nil if there's no such client.
+func (r *RuntimeProxy) clientById(id string) client {
+	for _, client := range r.clients {
+		if client.getID() == id {
+			return client
+		}
+	}
+	return nil
+}
+
+func (r *RuntimeProxy) clientForSandbox(req RunPodSandboxRequest) (client, error) {
+	if client, found := r.handlerClients[req.RuntimeHandler()]; found && req.RuntimeHandler() != "" {
+		if err := <-client.connect(); err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	return r.clientForAnnotations(req.GetAnnotations())
+}
+
 func (r *RuntimeProxy) clientForAnnotations(annotations map[string]string) (client, error) {
 	for _, client := range r.clients {
 		if client.annotationsMatch(annotations) {
@@ -160,13 +526,17 @@ func (r *RuntimeProxy) clientForAnnotations(annotations map[string]string) (clie
 	return nil, fmt.Errorf("criproxy: unknown runtime: %q", annotations[targetRuntimeAnnotationKey])
 }
 
-func (r *RuntimeProxy) clientForId(id string) (client, string, error) {
+func (r *RuntimeProxy) clientForId(id string, noErrorIfNotConnected bool) (client, string, error) {
 	client := r.clients[0]
 	unprefixed := id
 	for _, c := range r.clients[1:] {
 		if ok, unpref := c.idPrefixMatches(id); ok {
 			c.connect()
+			// don't wait for additional runtimes
 			if c.currentState() != clientStateConnected {
+				if noErrorIfNotConnected {
+					return nil, "", nil
+				}
 				return nil, "", fmt.Errorf("CRI proxy: target runtime is not available")
 			}
 			client = c
@@ -181,21 +551,18 @@ func (r *RuntimeProxy) clientForId(id string) (client, string, error) {
 }
 
 func (r *RuntimeProxy) clientForImage(image string, noErrorIfNotConnected bool) (client, string, error) {
-	client := r.clients[0]
-	unprefixed := image
-	for _, c := range r.clients[1:] {
-		if ok, unpref := c.imageMatches(image); ok {
-			c.connect()
-			// don't wait for additional runtimes
-			if c.currentState() != clientStateConnected {
-				if noErrorIfNotConnected {
-					return nil, "", nil
-				}
-				return nil, "", fmt.Errorf("CRI proxy: target runtime is not available")
+	client, unprefixed, err := r.routeImage(image)
+	if err != nil {
+		return nil, "", err
+	}
+	if !client.isPrimary() {
+		client.connect()
+		// don't wait for additional runtimes
+		if client.currentState() != clientStateConnected {
+			if noErrorIfNotConnected {
+				return nil, "", nil
 			}
-			client = c
-			unprefixed = unpref
-			break
+			return nil, "", fmt.Errorf("CRI proxy: target runtime is not available")
 		}
 	}
 	if err := <-client.connect(); err != nil {
@@ -204,6 +571,70 @@ func (r *RuntimeProxy) clientForImage(image string, noErrorIfNotConnected bool)
 	return client, unprefixed, nil
 }
 
+// routeImage returns the client that handles the specified image
+// along with the image name with the runtime prefix stripped.
+// It returns InvalidArgument error if the image doesn't have a
+// runtime prefix and there's no default runtime. It doesn't try
+// to connect to the runtime.
+func (r *RuntimeProxy) routeImage(image string) (client, string, error) {
+	for _, c := range r.clients {
+		if c.imageName("") == "" {
+			// the primary runtime that handles unprefixed images
+			continue
+		}
+		if ok, unprefixed := c.imageMatches(image); ok {
+			return c, unprefixed, nil
+		}
+	}
+	if r.defaultClient == nil {
+		return nil, "", grpc.Errorf(codes.InvalidArgument, "criproxy: image %q doesn't have a runtime prefix and there's no default runtime", image)
+	}
+	return r.defaultClient, image, nil
+}
+
+// ResolveRoute returns the id of the runtime that handles the
+// specified image along with the image name that's passed to that
+// runtime, i.e. with the runtime prefix stripped and the registry
+// mirrors applied. The id of the primary runtime is an empty string.
+// ResolveRoute doesn't try to contact any runtimes.
+func (r *RuntimeProxy) ResolveRoute(image string) (string, string, error) {
+	if image == "" {
+		return "", "", errors.New("criproxy: no image specified")
+	}
+	client, unprefixed, err := r.routeImage(image)
+	if err != nil {
+		return "", "", err
+	}
+	return client.getID(), r.mirrors.rewrite(unprefixed), nil
+}
+
+// DefaultRuntime returns the id of the runtime that handles the
+// images without a runtime prefix. The second return value is false
+// if there's no default runtime.
+func (r *RuntimeProxy) DefaultRuntime() (string, bool) {
+	if r.defaultClient == nil {
+		return "", false
+	}
+	return r.defaultClient.getID(), true
+}
+
+// RuntimeImageName returns the image name that makes the proxy pass
+// the image to the runtime with the specified id, i.e. the reverse
+// of ResolveRoute. The images of the default runtime are left
+// unprefixed. If the image name points to a registry mirror, the
+// original name is used.
+func (r *RuntimeProxy) RuntimeImageName(id, image string) (string, error) {
+	client := r.clientById(id)
+	if client == nil {
+		return "", fmt.Errorf("criproxy: unknown runtime %q", id)
+	}
+	image = r.mirrors.restore(image)
+	if client == r.defaultClient {
+		return image, nil
+	}
+	return client.imageName(image), nil
+}
+
 func (r *RuntimeProxy) fixStreamingUrl(url string) string {
 	// The URLs provided by dockershim in k8s 1.11+ look like this:
 	// //[::]:35057/cri/exec/tb8rgDBh
@@ -229,6 +660,21 @@ func (r *RuntimeProxy) passToPrimary(ctx context.Context, method string, req, re
 	return client.invokeWithErrorHandling(ctx, method, req, resp)
 }
 
+// version reports CRI Proxy as the runtime. The CRI API version
+// is taken from the primary runtime unless it's overridden.
+func (r *RuntimeProxy) version(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
+	if _, err := r.passToPrimary(ctx, method, req, resp); err != nil {
+		return nil, err
+	}
+	out := resp.(VersionResponse)
+	out.SetRuntimeName(r.runtimeName)
+	out.SetRuntimeVersion(version.Version)
+	if r.runtimeApiVersion != "" {
+		out.SetRuntimeApiVersion(r.runtimeApiVersion)
+	}
+	return resp, nil
+}
+
 func (r *RuntimeProxy) updateRuntimeConfig(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
 	var errs []string
 	for _, client := range r.clients {
@@ -260,28 +706,36 @@ func (r *RuntimeProxy) listObjects(ctx context.Context, method string, req, resp
 	if in, ok := req.(IdFilterObject); ok && in.IdFilter() != "" {
 		var unprefixed string
 		var err error
-		singleClient, unprefixed, err = r.clientForId(in.IdFilter())
+		singleClient, unprefixed, err = r.clientForId(in.IdFilter(), true)
 		if err != nil {
 			return nil, err
 		}
+		if singleClient == nil {
+			// The target client is offline
+			out.SetItems(nil)
+			return resp, nil
+		}
 		in.SetIdFilter(unprefixed)
 		useSingleClient = true
 	}
 
 	if in, ok := req.(PodSandboxIdFilterObject); ok && in.PodSandboxIdFilter() != "" {
-		anotherClient, unprefixed, err := r.clientForId(in.PodSandboxIdFilter())
+		anotherClient, unprefixed, err := r.clientForId(in.PodSandboxIdFilter(), true)
 		if err != nil {
 			return nil, err
 		}
-		if anotherClient != nil {
-			in.SetPodSandboxIdFilter(unprefixed)
-			if singleClient == nil {
-				singleClient = anotherClient
-			} else if singleClient != anotherClient {
-				// different id prefixes for sandbox & container
-				out.SetItems(nil)
-				return resp, nil
-			}
+		if anotherClient == nil {
+			// The target client is offline
+			out.SetItems(nil)
+			return resp, nil
+		}
+		in.SetPodSandboxIdFilter(unprefixed)
+		if singleClient == nil {
+			singleClient = anotherClient
+		} else if singleClient != anotherClient {
+			// different id prefixes for sandbox & container
+			out.SetItems(nil)
+			return resp, nil
 		}
 		useSingleClient = true
 	}
@@ -292,7 +746,7 @@ func (r *RuntimeProxy) listObjects(ctx context.Context, method string, req, resp
 			return nil, err
 		}
 		if anotherClient != nil {
-			in.SetImageFilter(unprefixed)
+			in.SetImageFilter(r.mirrors.rewrite(unprefixed))
 			if singleClient == nil {
 				singleClient = anotherClient
 			} else if singleClient != anotherClient {
@@ -327,17 +781,27 @@ func (r *RuntimeProxy) listObjects(ctx context.Context, method string, req, resp
 
 		out.SetItems(nil)
 		_, err := client.invoke(ctx, method, req, resp)
-		if err != nil {
+		if grpc.Code(err) == codes.ResourceExhausted {
+			// an incomplete list may make kubelet think that
+			// some of the objects are gone
+			return nil, err
+		}
+		switch {
+		case err == nil:
+		case grpc.Code(err) == codes.Unimplemented:
+			// the runtime doesn't support this List* method
+			// (e.g. ListContainerStats), so just omit its items
+			glog.V(criErrorLogLevel).Infof("List request is not implemented by runtime %q: %v", client.getID(), err)
+		default:
 			// if the runtime server is gone, let's just skip it
-			err = client.handleError(err, true)
-			if err != nil {
+			if err = client.handleError(err, true); err != nil {
 				// for more serious errors, log a warning but don't
 				// block the other runtimes by making List* fail
 				glog.Warningf("List request failed for runtime %q: %v", client.getID(), err)
 			}
 		}
 		for _, item := range out.Items() {
-			items = append(items, client.addPrefix(item))
+			items = append(items, client.addPrefix(r.mirrors.restoreObject(item)))
 		}
 	}
 
@@ -346,9 +810,40 @@ func (r *RuntimeProxy) listObjects(ctx context.Context, method string, req, resp
 
 }
 
+// imageFsInfo merges image filesystem info from all the runtimes.
+// The runtimes may share the filesystems, so the duplicate entries
+// are removed to avoid counting the same filesystem several times.
+func (r *RuntimeProxy) imageFsInfo(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
+	if _, err := r.listObjects(ctx, method, req, resp); err != nil {
+		return nil, err
+	}
+	out := resp.(ObjectList)
+	out.SetItems(dedupFilesystems(out.Items()))
+	return resp, nil
+}
+
+// dedupFilesystems removes the filesystem usage entries with the same
+// filesystem id, keeping the first one. The entries without an id are
+// kept.
+func dedupFilesystems(items []CRIObject) []CRIObject {
+	seen := make(map[string]bool)
+	var r []CRIObject
+	for _, item := range items {
+		id := item.(FilesystemUsage).FsId()
+		if id != "" {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+		}
+		r = append(r, item)
+	}
+	return r
+}
+
 func (r *RuntimeProxy) invokePodSandboxMethod(ctx context.Context, method string, req, resp CRIObject) (client, error) {
 	in := req.(PodSandboxIdObject)
-	client, unprefixed, err := r.clientForId(in.PodSandboxId())
+	client, unprefixed, err := r.clientForId(in.PodSandboxId(), false)
 	if err != nil {
 		return nil, err
 	}
@@ -359,7 +854,7 @@ func (r *RuntimeProxy) invokePodSandboxMethod(ctx context.Context, method string
 
 func (r *RuntimeProxy) invokeContainerMethod(ctx context.Context, method string, req, resp CRIObject) (client, error) {
 	in := req.(ContainerIdObject)
-	client, unprefixed, err := r.clientForId(in.ContainerId())
+	client, unprefixed, err := r.clientForId(in.ContainerId(), false)
 	if err != nil {
 		return nil, err
 	}
@@ -371,7 +866,7 @@ func (r *RuntimeProxy) invokeContainerMethod(ctx context.Context, method string,
 }
 
 func (r *RuntimeProxy) runPodSandbox(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
-	client, err := r.clientForAnnotations(req.(RunPodSandboxRequest).GetAnnotations())
+	client, err := r.clientForSandbox(req.(RunPodSandboxRequest))
 	if err != nil {
 		return nil, err
 	}
@@ -405,7 +900,7 @@ func (r *RuntimeProxy) podSandboxStatus(ctx context.Context, method string, req,
 
 func (r *RuntimeProxy) createContainer(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
 	in := req.(CreateContainerRequest)
-	client, unprefixed, err := r.clientForId(in.PodSandboxId())
+	client, unprefixed, err := r.clientForId(in.PodSandboxId(), false)
 	if err != nil {
 		return nil, err
 	}
@@ -424,7 +919,7 @@ func (r *RuntimeProxy) createContainer(ctx context.Context, method string, req,
 		if imageClient != client {
 			return nil, fmt.Errorf("criproxy: image %q is for a wrong runtime", in.Image())
 		}
-		in.SetImage(unprefixedImage)
+		in.SetImage(r.mirrors.rewrite(unprefixedImage))
 	}
 
 	_, err = client.invokeWithErrorHandling(ctx, method, req, resp)
@@ -454,7 +949,7 @@ func (r *RuntimeProxy) containerStatus(ctx context.Context, method string, req,
 	}
 	if status := resp.(ContainerStatusResponse).Status(); status != nil {
 		status.SetId(client.augmentId(status.Id()))
-		status.SetImage(client.imageName(status.Image()))
+		status.SetImage(client.imageName(r.mirrors.restore(status.Image())))
 	}
 	return resp, nil
 }
@@ -470,14 +965,26 @@ func (r *RuntimeProxy) containerStats(ctx context.Context, method string, req, r
 	return resp, nil
 }
 
+// handleImage passes the request to the runtime that handles the
+// image. If the runtime is offline, its images are treated as absent.
 func (r *RuntimeProxy) handleImage(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
+	return r.invokeImageMethod(ctx, method, req, resp, true)
+}
+
+// invokeImageMethod passes the request to the runtime that handles
+// the image. If the runtime is offline, it returns an empty response
+// if noErrorIfOffline is true and an error otherwise.
+func (r *RuntimeProxy) invokeImageMethod(ctx context.Context, method string, req, resp CRIObject, noErrorIfOffline bool) (interface{}, error) {
 	in := req.(ImageObject)
-	client, unprefixed, err := r.clientForImage(in.Image(), true)
+	client, unprefixed, err := r.clientForImage(in.Image(), noErrorIfOffline)
+	if err != nil {
+		return nil, err
+	}
 	if client == nil {
 		// the client is offline
 		return resp, nil
 	}
-	in.SetImage(unprefixed)
+	in.SetImage(r.mirrors.rewrite(unprefixed))
 
 	_, err = client.invokeWithErrorHandling(ctx, method, req, resp)
 	if err != nil {
@@ -485,19 +992,141 @@ func (r *RuntimeProxy) handleImage(ctx context.Context, method string, req, resp
 	}
 
 	if out, ok := resp.(ImageStatusResponse); ok && out.Image() != nil {
-		out.SetImage(client.addPrefix(out.Image()).(Image))
+		out.SetImage(client.addPrefix(r.mirrors.restoreImage(out.Image())).(Image))
 	}
 
 	if out, ok := resp.(ImageObject); ok {
-		out.SetImage(client.imageName(out.Image()))
+		out.SetImage(client.imageName(r.mirrors.restore(out.Image())))
 	}
 
 	return resp, err
 }
 
+// removeImage passes RemoveImage request to the runtime that handles
+// the image. The image ids that are digests don't have a runtime
+// prefix, so the image may be present in several runtimes. Such
+// images are removed from all of the runtimes, relying on RemoveImage
+// being idempotent, and the request only succeeds if all of them
+// confirm the removal.
+func (r *RuntimeProxy) removeImage(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
+	in := req.(ImageObject)
+	if _, err := digest.Parse(in.Image()); err != nil {
+		// the removal of an image of an offline runtime
+		// must not be reported as successful
+		return r.invokeImageMethod(ctx, method, req, resp, false)
+	}
+
+	var errs []string
+	for _, client := range r.clients {
+		// don't wait for additional runtimes
+		if !client.isPrimary() && client.currentState() != clientStateConnected {
+			client.connect()
+			errs = append(errs, fmt.Sprintf("runtime %q is not available", runtimeLabel(client)))
+			continue
+		}
+		if err := <-client.connect(); err != nil {
+			errs = append(errs, fmt.Sprintf("runtime %q: %v", runtimeLabel(client), err))
+			continue
+		}
+		if _, err := client.invokeWithErrorHandling(ctx, method, req, resp); err != nil {
+			errs = append(errs, fmt.Sprintf("runtime %q: %v", runtimeLabel(client), err))
+		}
+	}
+
+	if errs != nil {
+		return nil, fmt.Errorf("criproxy: failed to remove image %q: %s", in.Image(), strings.Join(errs, "; "))
+	}
+	return resp, nil
+}
+
+// pullImage passes PullImage request to the runtime. Concurrent pulls
+// of the same image from the same runtime are coalesced unless they
+// contain registry credentials passed by kubelet, as the credentials
+// of different pods may grant access to different images.
+func (r *RuntimeProxy) pullImage(ctx context.Context, method string, req, resp CRIObject) (interface{}, error) {
+	in := req.(PullImageRequest)
+	client, unprefixed, err := r.routeImage(in.Image())
+	if err != nil {
+		return nil, err
+	}
+	hasKubeletAuth := in.HasAuth()
+	r.addRegistryAuth(client, in)
+	registry := registryLabel(unprefixed)
+	if hasKubeletAuth {
+		return r.limitedPull(ctx, client, registry, method, req, resp)
+	}
+	return r.pulls.do(ctx, client.getID()+"/"+unprefixed, func(ctx context.Context) (interface{}, error) {
+		return r.limitedPull(ctx, client, registry, method, req, resp)
+	})
+}
+
+// addRegistryAuth adds the registry credentials configured for the
+// runtime to PullImage request unless the request already contains
+// the credentials passed by kubelet
+func (r *RuntimeProxy) addRegistryAuth(client client, req PullImageRequest) {
+	if auth := r.registryAuth[client.getID()]; auth != nil && !req.HasAuth() {
+		req.SetAuth(auth)
+	}
+}
+
+// limitedPull waits for a free pull slot of the runtime if the number
+// of parallel pulls is limited and then passes the request to it
+func (r *RuntimeProxy) limitedPull(ctx context.Context, client client, registry, method string, req, resp CRIObject) (interface{}, error) {
+	if r.pullSemaphores == nil {
+		return r.timedPull(ctx, client, registry, method, req, resp)
+	}
+
+	sem := r.pullSemaphores[client.getID()]
+	waiting := imagePullsWaiting.WithLabelValues(runtimeLabel(client))
+	waiting.Inc()
+	select {
+	case sem <- struct{}{}:
+		waiting.Dec()
+	case <-ctx.Done():
+		waiting.Dec()
+		return nil, ctx.Err()
+	}
+	defer func() { <-sem }()
+
+	return r.timedPull(ctx, client, registry, method, req, resp)
+}
+
+// timedPull passes PullImage request to the runtime and records the
+// pull metrics
+func (r *RuntimeProxy) timedPull(ctx context.Context, client client, registry, method string, req, resp CRIObject) (interface{}, error) {
+	start := time.Now()
+	out, err := r.handleImage(ctx, method, req, resp)
+	if err != nil || client.currentState() != clientStateConnected {
+		return out, err
+	}
+	imagePullDuration.WithLabelValues(runtimeLabel(client), registry).Observe(time.Since(start).Seconds())
+	if r.pullImageSizeMetrics {
+		// the request contains the image name as it was passed
+		// to the runtime at this point
+		r.recordImageSize(ctx, client, registry, req.(PullImageRequest).Image())
+	}
+	return out, nil
+}
+
+// recordImageSize requests the status of the pulled image from the
+// runtime and records its size
+func (r *RuntimeProxy) recordImageSize(ctx context.Context, client client, registry, image string) {
+	req, resp, err := r.criVersion.WrapObject(r.criVersion.ImageStatusRequest(image))
+	if err == nil {
+		_, err = client.invokeWithErrorHandling(ctx, r.methodPrefix+imageServicePrefix+"ImageStatus", req, resp)
+	}
+	if err != nil {
+		glog.Warningf("Failed to get the status of image %q pulled by runtime %q: %v", image, client.getID(), err)
+		return
+	}
+	if img := resp.(ImageStatusResponse).Image(); img != nil {
+		pulledImageSize.WithLabelValues(runtimeLabel(client), registry).Observe(float64(img.Size()))
+	}
+}
+
 var dispatchTable = map[string]dispatchItem{
-	"RuntimeService/Version":                  {(*RuntimeProxy).passToPrimary, criNoisyLogLevel},
-	"RuntimeService/Status":                   {(*RuntimeProxy).passToPrimary, criNoisyLogLevel},
+	"RuntimeService/Version":                  {(*RuntimeProxy).version, criNoisyLogLevel},
+	"RuntimeService/Status":                   {(*RuntimeProxy).status, criNoisyLogLevel},
 	"RuntimeService/UpdateRuntimeConfig":      {(*RuntimeProxy).updateRuntimeConfig, criRequestLogLevel},
 	"RuntimeService/RunPodSandbox":            {(*RuntimeProxy).runPodSandbox, criRequestLogLevel},
 	"RuntimeService/ListPodSandbox":           {(*RuntimeProxy).listObjects, criListLogLevel},
@@ -520,9 +1149,9 @@ var dispatchTable = map[string]dispatchItem{
 	"RuntimeService/PortForward":              {(*RuntimeProxy).handlePodSandbox, criRequestLogLevel},
 	"ImageService/ListImages":                 {(*RuntimeProxy).listObjects, criListLogLevel},
 	"ImageService/ImageStatus":                {(*RuntimeProxy).handleImage, criNoisyLogLevel},
-	"ImageService/PullImage":                  {(*RuntimeProxy).handleImage, criRequestLogLevel},
-	"ImageService/RemoveImage":                {(*RuntimeProxy).handleImage, criRequestLogLevel},
-	"ImageService/ImageFsInfo":                {(*RuntimeProxy).listObjects, criRequestLogLevel},
+	"ImageService/PullImage":                  {(*RuntimeProxy).pullImage, criRequestLogLevel},
+	"ImageService/RemoveImage":                {(*RuntimeProxy).removeImage, criRequestLogLevel},
+	"ImageService/ImageFsInfo":                {(*RuntimeProxy).imageFsInfo, criRequestLogLevel},
 }
 
 var replaceRx = regexp.MustCompile(`\(\*(v1alpha2.\w+)\)\(0x[0-9a-f]+\)`)
@@ -17,25 +17,48 @@ limitations under the License.
 package proxy
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pmezard/go-difflib/difflib"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 
 	proxytest "github.com/Mirantis/criproxy/pkg/proxy/testing"
 	"github.com/Mirantis/criproxy/pkg/runtimeapis"
 	v1_12 "github.com/Mirantis/criproxy/pkg/runtimeapis/v1_12"
 	runtimeapi "github.com/Mirantis/criproxy/pkg/runtimeapis/v1_9"
 	"github.com/Mirantis/criproxy/pkg/utils"
+	"github.com/Mirantis/criproxy/pkg/version"
 )
 
 const (
@@ -88,13 +111,14 @@ type proxyTester struct {
 	proxy           *RuntimeProxy
 	proxyServer     *Server
 	conn            *grpc.ClientConn
+	opts            RuntimeProxyOptions
 	containerStats  []*runtimeapi.ContainerStats
 	filesystemUsage []*runtimeapi.FilesystemUsage
 }
 
 type makeFakeCriServerFunc func(journal proxytest.Journal, streamUrl string) proxytest.FakeCriServer
 
-func newProxyTester(t *testing.T, secondSocketSpec string, fakeCriServerMakers []makeFakeCriServerFunc) *proxyTester {
+func newProxyTester(t *testing.T, secondSocketSpec string, fakeCriServerMakers []makeFakeCriServerFunc, opts RuntimeProxyOptions) *proxyTester {
 	journal := proxytest.NewSimpleJournal()
 	servers := []proxytest.FakeCriServer{
 		fakeCriServerMakers[0](proxytest.NewPrefixJournal(journal, "1/"), "/cri"),
@@ -123,17 +147,11 @@ func newProxyTester(t *testing.T, secondSocketSpec string, fakeCriServerMakers [
 		servers:         servers,
 		containerStats:  containerStats,
 		filesystemUsage: filesystemUsage,
-	}
-	// NOTE: in reality the loopback address should not be
-	// actually used for streaming unless you're absolutely sure
-	// that the only apiserver instance resides on this node
-	streamUrl, err := url.Parse("http://127.0.0.1:11250/")
-	if err != nil {
-		t.Fatalf("error parsing stream url: %v", err)
+		opts:            opts,
 	}
 	var interceptors []Interceptor
 	for _, criVersion := range []CRIVersion{&CRI19{}, &CRI112{}} {
-		proxy, err := NewRuntimeProxy(criVersion, []string{fakeCriSocketPath1, secondSocketSpec}, connectionTimeoutForTests, streamUrl)
+		proxy, err := NewRuntimeProxy(criVersion, []string{fakeCriSocketPath1, secondSocketSpec}, connectionTimeoutForTests, testStreamUrl(), opts)
 		if err != nil {
 			t.Fatalf("failed to create runtime proxy: %v", err)
 		}
@@ -141,11 +159,26 @@ func newProxyTester(t *testing.T, secondSocketSpec string, fakeCriServerMakers [
 	}
 	tester.proxyServer = NewServer(interceptors, func() {
 		tester.hookCallCount++
-	})
+	}, opts.ServerOptions()...)
 
 	return tester
 }
 
+// testStreamUrl returns the streaming URL to be used by the proxies
+// in the tests.
+// NOTE: in reality the loopback address should not be
+// actually used for streaming unless you're absolutely sure
+// that the only apiserver instance resides on this node
+func testStreamUrl() *url.URL {
+	return &url.URL{Scheme: "http", Host: "127.0.0.1:11250", Path: "/"}
+}
+
+// newTestRuntimeProxy creates a CRI 1.9 RuntimeProxy for the tests
+// that invoke its methods directly instead of going through gRPC.
+func newTestRuntimeProxy(addrs []string, opts RuntimeProxyOptions) (*RuntimeProxy, error) {
+	return NewRuntimeProxy(&CRI19{}, addrs, connectionTimeoutForTests, testStreamUrl(), opts)
+}
+
 func (tester *proxyTester) startServers(t *testing.T, which int) {
 	paths := []string{fakeCriSocketPath1, fakeCriSocketPath2}
 	for i := 0; i < 2; i++ {
@@ -189,6 +222,33 @@ func (tester *proxyTester) verifyJournal(t *testing.T, expectedItems []string) {
 	}
 }
 
+// waitForAltRuntime waits till the proxy connects to the second
+// runtime, which happens in background, by listing the images until
+// the images of both runtimes are there.
+func (tester *proxyTester) waitForAltRuntime(t *testing.T) {
+	// listObjects skips the runtimes that aren't connected, so
+	// wait for the primary runtime to make the journal predictable
+	primary := tester.proxyServer.interceptors[0].(*RuntimeProxy).clients[0]
+	if err := <-primary.connect(); err != nil {
+		t.Fatalf("error connecting to the primary runtime: %v", err)
+	}
+	for i := 0; ; i++ {
+		if i == 100 {
+			t.Fatalf("2nd client didn't activate")
+		}
+		var resp runtimeapi.ListImagesResponse
+		if err := tester.invoke("/runtime.ImageService/ListImages", &runtimeapi.ListImagesRequest{}, &resp); err != nil {
+			t.Fatalf("ListImages() failed while waiting for 2nd client to connect: %v", err)
+		}
+		if len(resp.GetImages()) == 4 {
+			tester.verifyJournal(t, []string{"1/image/ListImages", "2/image/ListImages"})
+			return
+		}
+		tester.verifyJournal(t, []string{"1/image/ListImages"})
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
 func (tester *proxyTester) invoke(method string, in, resp interface{}) error {
 	return grpc.Invoke(context.Background(), method, in, resp, tester.conn)
 }
@@ -228,7 +288,7 @@ func (tester *proxyTester) verifyCall(t *testing.T, method string, in, resp inte
 }
 
 func verifyCRIProxy(t *testing.T, secondSocketSpec string, useNewCriVersionForProxy bool, fakeCriServerMakers []makeFakeCriServerFunc) {
-	tester := newProxyTester(t, secondSocketSpec, fakeCriServerMakers)
+	tester := newProxyTester(t, secondSocketSpec, fakeCriServerMakers, RuntimeProxyOptions{})
 	defer tester.stop()
 	tester.startServers(t, -1)
 	tester.startProxy(t)
@@ -263,8 +323,8 @@ func verifyCRIProxy(t *testing.T, secondSocketSpec string, useNewCriVersionForPr
 			in:     &runtimeapi.VersionRequest{},
 			resp: &runtimeapi.VersionResponse{
 				Version:           "0.1.0",
-				RuntimeName:       "fakeRuntime",
-				RuntimeVersion:    "0.1.0",
+				RuntimeName:       "criproxy",
+				RuntimeVersion:    version.Version,
 				RuntimeApiVersion: "0.1.0",
 			},
 			// the first Version request is done by CRI proxy itself
@@ -1479,7 +1539,7 @@ func TestCriProxyInactiveServers(t *testing.T) {
 	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
 		proxytest.NewFakeCriServer19,
 		proxytest.NewFakeCriServer19,
-	})
+	}, RuntimeProxyOptions{})
 	defer tester.stop()
 	tester.startServers(t, 0)
 
@@ -1620,6 +1680,14 @@ func TestCriProxyInactiveServers(t *testing.T) {
 		&runtimeapi.ImageStatusResponse{}, "")
 	tester.verifyJournal(t, nil)
 
+	// the image can't be removed while its runtime is offline
+	tester.verifyCall(t, "/runtime.ImageService/RemoveImage",
+		&runtimeapi.RemoveImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "alt/image2-1"},
+		},
+		&runtimeapi.RemoveImageResponse{}, "target runtime is not available")
+	tester.verifyJournal(t, nil)
+
 	// no runtimes are called here because the runtime for alt/ prefix is offline
 	tester.verifyCall(t, "/runtime.ImageService/ListImages",
 		&runtimeapi.ListImagesRequest{
@@ -1639,6 +1707,1689 @@ func TestCriProxyInactiveServers(t *testing.T) {
 		&runtimeapi.ListContainersRequest{},
 		&runtimeapi.ListContainersResponse{}, "")
 	tester.verifyJournal(t, []string{"1/runtime/ListContainers"})
+
+	// no runtimes are called here because the runtime for alt__ prefix is offline
+	tester.verifyCall(t, "/runtime.RuntimeService/ListContainers",
+		&runtimeapi.ListContainersRequest{
+			Filter: &runtimeapi.ContainerFilter{Id: containerId2},
+		},
+		&runtimeapi.ListContainersResponse{}, "")
+	tester.verifyJournal(t, nil)
+
+	// no runtimes are called here because the runtime for alt__ prefix is offline
+	tester.verifyCall(t, "/runtime.RuntimeService/ListContainers",
+		&runtimeapi.ListContainersRequest{
+			Filter: &runtimeapi.ContainerFilter{PodSandboxId: podSandboxId2},
+		},
+		&runtimeapi.ListContainersResponse{}, "")
+	tester.verifyJournal(t, nil)
+
+	// no runtimes are called here because the runtime for alt__ prefix is offline
+	tester.verifyCall(t, "/runtime.RuntimeService/ListPodSandbox",
+		&runtimeapi.ListPodSandboxRequest{
+			Filter: &runtimeapi.PodSandboxFilter{Id: podSandboxId2},
+		},
+		&runtimeapi.ListPodSandboxResponse{}, "")
+	tester.verifyJournal(t, nil)
+}
+
+func TestCriProxyDefaultRuntime(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{DefaultRuntime: "alt"})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	tester.waitForAltRuntime(t)
+
+	// unprefixed images go to the default runtime
+	tester.verifyCall(t, "/runtime.ImageService/PullImage",
+		&runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "image2-3"},
+		},
+		&runtimeapi.PullImageResponse{ImageRef: "alt/image2-3"}, "")
+	tester.verifyJournal(t, []string{"2/image/PullImage"})
+
+	tester.verifyCall(t, "/runtime.ImageService/ImageStatus",
+		&runtimeapi.ImageStatusRequest{
+			Image: &runtimeapi.ImageSpec{Image: "alt/image2-3"},
+		},
+		&runtimeapi.ImageStatusResponse{
+			Image: &runtimeapi.Image{
+				Id:       "alt/image2-3",
+				RepoTags: []string{"alt/image2-3"},
+				Size_:    fakeImageSize2,
+			},
+		}, "")
+	tester.verifyJournal(t, []string{"2/image/ImageStatus"})
+
+	// the images of the primary runtime are prefixed with "primary/"
+	tester.verifyCall(t, "/runtime.ImageService/ImageStatus",
+		&runtimeapi.ImageStatusRequest{
+			Image: &runtimeapi.ImageSpec{Image: "primary/image1-1"},
+		},
+		&runtimeapi.ImageStatusResponse{
+			Image: &runtimeapi.Image{
+				Id:       "primary/image1-1",
+				RepoTags: []string{"primary/image1-1"},
+				Size_:    fakeImageSize1,
+			},
+		}, "")
+	tester.verifyJournal(t, []string{"1/image/ImageStatus"})
+
+	// so the pods of the primary runtime can use them
+	tester.verifyCall(t, "/runtime.RuntimeService/RunPodSandbox",
+		&runtimeapi.RunPodSandboxRequest{
+			Config: &runtimeapi.PodSandboxConfig{
+				Metadata: &runtimeapi.PodSandboxMetadata{
+					Name:      "pod-1-1",
+					Uid:       podUid1,
+					Namespace: "default",
+					Attempt:   0,
+				},
+			},
+		},
+		&runtimeapi.RunPodSandboxResponse{PodSandboxId: podSandboxId1}, "")
+	tester.verifyJournal(t, []string{"1/runtime/RunPodSandbox"})
+
+	tester.verifyCall(t, "/runtime.RuntimeService/CreateContainer",
+		&runtimeapi.CreateContainerRequest{
+			PodSandboxId: podSandboxId1,
+			Config: &runtimeapi.ContainerConfig{
+				Metadata: &runtimeapi.ContainerMetadata{
+					Name:    "container1",
+					Attempt: 0,
+				},
+				Image: &runtimeapi.ImageSpec{
+					Image: "primary/image1-1",
+				},
+			},
+		},
+		&runtimeapi.CreateContainerResponse{ContainerId: containerId1}, "")
+	tester.verifyJournal(t, []string{"1/runtime/CreateContainer"})
+}
+
+func TestListContainerStatsUnimplemented(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+	tester.waitForAltRuntime(t)
+
+	tester.servers[0].(*proxytest.FakeCriServer19).SetFakeContainers([]*proxytest.FakeContainer19{
+		{
+			ContainerStatus: runtimeapi.ContainerStatus{Id: containerId1},
+			SandboxID:       podSandboxId1,
+		},
+	})
+	tester.servers[1].SetFakeStatsUnimplemented(true)
+
+	// the stats of the runtime that doesn't implement them are
+	// omitted without failing the whole call
+	tester.verifyCall(t, "/runtime.RuntimeService/ListContainerStats",
+		&runtimeapi.ListContainerStatsRequest{},
+		&runtimeapi.ListContainerStatsResponse{
+			Stats: []*runtimeapi.ContainerStats{tester.containerStats[0]},
+		}, "")
+	tester.verifyJournal(t, []string{"1/runtime/ListContainerStats", "2/runtime/ListContainerStats"})
+
+	// and the runtime stays connected
+	r := tester.proxyServer.interceptors[0].(*RuntimeProxy)
+	if state := r.clients[1].currentState(); state != clientStateConnected {
+		t.Errorf("the runtime got disconnected after Unimplemented error (state %v)", state)
+	}
+}
+
+func TestCriProxyNoDefaultRuntime(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{NoDefaultRuntime: true})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+	tester.waitForAltRuntime(t)
+
+	tester.verifyCall(t, "/runtime.ImageService/PullImage",
+		&runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "primary/image1-3"},
+		},
+		&runtimeapi.PullImageResponse{ImageRef: "primary/image1-3"}, "")
+	tester.verifyJournal(t, []string{"1/image/PullImage"})
+
+	tester.verifyCall(t, "/runtime.ImageService/PullImage",
+		&runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "alt/image2-3"},
+		},
+		&runtimeapi.PullImageResponse{ImageRef: "alt/image2-3"}, "")
+	tester.verifyJournal(t, []string{"2/image/PullImage"})
+
+	// unprefixed images are rejected
+	err := tester.invoke("/runtime.ImageService/PullImage", &runtimeapi.PullImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: "image1-3"},
+	}, &runtimeapi.PullImageResponse{})
+	if grpc.Code(err) != codes.InvalidArgument || !strings.Contains(grpc.ErrorDesc(err), `"image1-3"`) {
+		t.Errorf("PullImage(): expected InvalidArgument error naming the image, got %v", err)
+	}
+	err = tester.invoke("/runtime.ImageService/ImageStatus", &runtimeapi.ImageStatusRequest{
+		Image: &runtimeapi.ImageSpec{Image: "image1-3"},
+	}, &runtimeapi.ImageStatusResponse{})
+	if grpc.Code(err) != codes.InvalidArgument || !strings.Contains(grpc.ErrorDesc(err), `"image1-3"`) {
+		t.Errorf("ImageStatus(): expected InvalidArgument error naming the image, got %v", err)
+	}
+	// the runtimes aren't contacted for unprefixed images
+	tester.verifyJournal(t, nil)
+}
+
+func TestImagePrefixRoundTrip(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{NoDefaultRuntime: true})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+	tester.waitForAltRuntime(t)
+
+	altImages := tester.servers[1].(*proxytest.FakeCriServer19).FakeImageServer19
+	hasAltImage := func(image string) bool {
+		altImages.Lock()
+		defer altImages.Unlock()
+		_, found := altImages.Images[image]
+		return found
+	}
+
+	tester.verifyCall(t, "/runtime.ImageService/PullImage",
+		&runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "alt/image2-3"},
+		},
+		&runtimeapi.PullImageResponse{ImageRef: "alt/image2-3"}, "")
+	tester.verifyJournal(t, []string{"2/image/PullImage"})
+	// the runtime gets the image name without the prefix
+	if !hasAltImage("image2-3") {
+		t.Errorf("image2-3 wasn't pulled by the alt runtime")
+	}
+
+	// and the prefix is added back in the responses
+	expectedImage := &runtimeapi.Image{
+		Id:       "alt/image2-3",
+		RepoTags: []string{"alt/image2-3"},
+		Size_:    fakeImageSize2,
+	}
+	tester.verifyCall(t, "/runtime.ImageService/ImageStatus",
+		&runtimeapi.ImageStatusRequest{
+			Image: &runtimeapi.ImageSpec{Image: "alt/image2-3"},
+		},
+		&runtimeapi.ImageStatusResponse{Image: expectedImage}, "")
+	tester.verifyJournal(t, []string{"2/image/ImageStatus"})
+
+	tester.verifyCall(t, "/runtime.ImageService/ListImages",
+		&runtimeapi.ListImagesRequest{
+			Filter: &runtimeapi.ImageFilter{
+				Image: &runtimeapi.ImageSpec{Image: "alt/image2-3"},
+			},
+		},
+		&runtimeapi.ListImagesResponse{Images: []*runtimeapi.Image{expectedImage}}, "")
+	tester.verifyJournal(t, []string{"2/image/ListImages"})
+
+	tester.verifyCall(t, "/runtime.ImageService/RemoveImage",
+		&runtimeapi.RemoveImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "alt/image2-3"},
+		},
+		&runtimeapi.RemoveImageResponse{}, "")
+	tester.verifyJournal(t, []string{"2/image/RemoveImage"})
+	if hasAltImage("image2-3") {
+		t.Errorf("image2-3 wasn't removed by the alt runtime")
+	}
+
+	// routing errors are returned to kubelet instead of being
+	// reported as successful empty responses
+	tester.verifyCall(t, "/runtime.ImageService/RemoveImage",
+		&runtimeapi.RemoveImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "image2-1"},
+		},
+		&runtimeapi.RemoveImageResponse{}, "image \"image2-1\" doesn't have a runtime prefix")
+	tester.verifyJournal(t, nil)
+	if !hasAltImage("image2-1") {
+		t.Errorf("image2-1 was unexpectedly removed")
+	}
+}
+
+func TestBadDefaultRuntime(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		addrs []string
+		opts  RuntimeProxyOptions
+	}{
+		{
+			name:  "unknown default runtime",
+			addrs: []string{fakeCriSocketPath1, altSocketSpec},
+			opts:  RuntimeProxyOptions{DefaultRuntime: "nosuchruntime"},
+		},
+		{
+			name:  "default runtime together with no default runtime",
+			addrs: []string{fakeCriSocketPath1, altSocketSpec},
+			opts:  RuntimeProxyOptions{DefaultRuntime: "alt", NoDefaultRuntime: true},
+		},
+		{
+			name:  "runtime id that's reserved for the primary runtime",
+			addrs: []string{fakeCriSocketPath1, "primary:" + fakeCriSocketPath2},
+			opts:  RuntimeProxyOptions{NoDefaultRuntime: true},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newTestRuntimeProxy(tc.addrs, tc.opts); err == nil {
+				t.Errorf("NewRuntimeProxy() didn't fail")
+			}
+		})
+	}
+}
+
+func TestRuntimeHandlerRouting(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer110,
+		proxytest.NewFakeCriServer110,
+	}, RuntimeProxyOptions{
+		RuntimeHandlers: map[string]string{
+			"runc": "",
+			"kata": "alt",
+		},
+	})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	for _, tc := range []struct {
+		name, handler, targetRuntime, podSandboxId, journalItem string
+	}{
+		{
+			name:         "handler for alt runtime",
+			handler:      "kata",
+			podSandboxId: podSandboxId2,
+			journalItem:  "2/runtime/RunPodSandbox",
+		},
+		{
+			name:          "handler for primary runtime takes precedence over the annotation",
+			handler:       "runc",
+			targetRuntime: "alt",
+			podSandboxId:  podSandboxId2unprefixed,
+			journalItem:   "1/runtime/RunPodSandbox",
+		},
+		{
+			name:          "unknown handler falls back to the annotation",
+			handler:       "foobar",
+			targetRuntime: "alt",
+			podSandboxId:  podSandboxId2,
+			journalItem:   "2/runtime/RunPodSandbox",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &v1_12.PodSandboxConfig{
+				Metadata: &v1_12.PodSandboxMetadata{
+					Name:      "pod-2-1",
+					Uid:       podUid2,
+					Namespace: "default",
+					Attempt:   0,
+				},
+			}
+			if tc.targetRuntime != "" {
+				config.Annotations = map[string]string{
+					"kubernetes.io/target-runtime": tc.targetRuntime,
+				}
+			}
+			tester.verifyCall(t, "/runtime.v1alpha2.RuntimeService/RunPodSandbox",
+				&v1_12.RunPodSandboxRequest{
+					Config:         config,
+					RuntimeHandler: tc.handler,
+				},
+				&v1_12.RunPodSandboxResponse{PodSandboxId: tc.podSandboxId}, "")
+			tester.verifyJournal(t, []string{tc.journalItem})
+		})
+	}
+}
+
+func TestResolveRoute(t *testing.T) {
+	addrs := []string{fakeCriSocketPath1, altSocketSpec, "virtlet.cloud:/run/virtlet.sock"}
+	for _, tc := range []struct {
+		name, defaultRuntime, image, runtime, unprefixed, error string
+		noDefaultRuntime                                        bool
+		mirrors                                                 map[string]string
+	}{
+		{
+			name:       "primary",
+			image:      "busybox:latest",
+			runtime:    "",
+			unprefixed: "busybox:latest",
+		},
+		{
+			name:       "alt",
+			image:      "alt/busybox:latest",
+			runtime:    "alt",
+			unprefixed: "busybox:latest",
+		},
+		{
+			name:       "runtime id with a dot",
+			image:      "virtlet.cloud/image-service/cirros",
+			runtime:    "virtlet.cloud",
+			unprefixed: "image-service/cirros",
+		},
+		{
+			name:       "registry that's not a runtime",
+			image:      "docker.io/library/busybox",
+			runtime:    "",
+			unprefixed: "docker.io/library/busybox",
+		},
+		{
+			name:           "default runtime",
+			defaultRuntime: "alt",
+			image:          "busybox",
+			runtime:        "alt",
+			unprefixed:     "busybox",
+		},
+		{
+			name:           "prefix with default runtime",
+			defaultRuntime: "alt",
+			image:          "virtlet.cloud/cirros",
+			runtime:        "virtlet.cloud",
+			unprefixed:     "cirros",
+		},
+		{
+			name:           "primary runtime with default runtime",
+			defaultRuntime: "alt",
+			image:          "primary/busybox",
+			runtime:        "",
+			unprefixed:     "busybox",
+		},
+		{
+			name:             "primary runtime without default runtime",
+			noDefaultRuntime: true,
+			image:            "primary/busybox",
+			runtime:          "",
+			unprefixed:       "busybox",
+		},
+		{
+			name:             "prefix without default runtime",
+			noDefaultRuntime: true,
+			image:            "alt/busybox",
+			runtime:          "alt",
+			unprefixed:       "busybox",
+		},
+		{
+			name:             "no prefix without default runtime",
+			noDefaultRuntime: true,
+			image:            "busybox",
+			error:            "image \"busybox\" doesn't have a runtime prefix",
+		},
+		{
+			name:  "empty image",
+			image: "",
+			error: "no image specified",
+		},
+		{
+			name:       "registry mirror",
+			mirrors:    map[string]string{"docker.io": "mirror.example.com:5000"},
+			image:      "docker.io/library/busybox",
+			runtime:    "",
+			unprefixed: "mirror.example.com:5000/library/busybox",
+		},
+		{
+			name:       "registry mirror with runtime prefix",
+			mirrors:    map[string]string{"docker.io": "mirror.example.com:5000"},
+			image:      "alt/docker.io/library/busybox",
+			runtime:    "alt",
+			unprefixed: "mirror.example.com:5000/library/busybox",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newTestRuntimeProxy(addrs, RuntimeProxyOptions{
+				DefaultRuntime:   tc.defaultRuntime,
+				NoDefaultRuntime: tc.noDefaultRuntime,
+				RegistryMirrors:  tc.mirrors,
+			})
+			if err != nil {
+				t.Fatalf("NewRuntimeProxy(): %v", err)
+			}
+			runtime, unprefixed, err := r.ResolveRoute(tc.image)
+			switch {
+			case tc.error == "" && err != nil:
+				t.Errorf("ResolveRoute(): %v", err)
+			case tc.error != "" && err == nil:
+				t.Errorf("ResolveRoute() didn't return the expected error")
+			case tc.error != "" && !strings.Contains(err.Error(), tc.error):
+				t.Errorf("bad error message: %q instead of %q", err.Error(), tc.error)
+			case runtime != tc.runtime || unprefixed != tc.unprefixed:
+				t.Errorf("ResolveRoute(%q) = %q, %q instead of %q, %q", tc.image, runtime, unprefixed, tc.runtime, tc.unprefixed)
+			}
+			if err != nil {
+				return
+			}
+			// RuntimeImageName must produce a name that's
+			// routed back to the same runtime
+			image, err := r.RuntimeImageName(runtime, unprefixed)
+			if err != nil {
+				t.Fatalf("RuntimeImageName(): %v", err)
+			}
+			if rt, unpref, err := r.ResolveRoute(image); err != nil || rt != runtime || unpref != unprefixed {
+				t.Errorf("ResolveRoute(%q) for RuntimeImageName(%q, %q) = %q, %q, %v", image, runtime, unprefixed, rt, unpref, err)
+			}
+		})
+	}
+}
+
+func TestImagePullLimit(t *testing.T) {
+	r, err := newTestRuntimeProxy([]string{fakeCriSocketPath1, altSocketSpec}, RuntimeProxyOptions{MaxParallelImagePulls: 1})
+	if err != nil {
+		t.Fatalf("NewRuntimeProxy(): %v", err)
+	}
+
+	// occupy the only pull slot of the primary runtime
+	r.pullSemaphores[""] <- struct{}{}
+	req, resp, err := r.criVersion.WrapObject(&runtimeapi.PullImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: "image1-3"},
+	})
+	if err != nil {
+		t.Fatalf("WrapObject(): %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := r.pullImage(ctx, "/runtime.ImageService/PullImage", req, resp); err != context.DeadlineExceeded {
+		t.Errorf("pullImage() returned %v instead of %v while waiting for a free slot", err, context.DeadlineExceeded)
+	}
+}
+
+func TestKeepaliveParams(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		opts           RuntimeProxyOptions
+		expectedParams keepaliveParams
+	}{
+		{
+			name: "no keepalive",
+		},
+		{
+			name: "keepalive",
+			opts: RuntimeProxyOptions{
+				KeepaliveTime:    5 * time.Minute,
+				KeepaliveTimeout: 20 * time.Second,
+			},
+			expectedParams: keepaliveParams{time: 5 * time.Minute, timeout: 20 * time.Second},
+		},
+		{
+			name: "keepalive timeout without keepalive time",
+			opts: RuntimeProxyOptions{
+				KeepaliveTimeout: 20 * time.Second,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newTestRuntimeProxy([]string{fakeCriSocketPath1, altSocketSpec}, tc.opts)
+			if err != nil {
+				t.Fatalf("NewRuntimeProxy(): %v", err)
+			}
+			// the settings must be passed to the connections
+			// of all of the runtimes
+			for _, c := range r.clients {
+				if params := c.(*autoClient).keepalive; params != tc.expectedParams {
+					t.Errorf("runtime %q: bad keepalive params: %#v instead of %#v", c.getID(), params, tc.expectedParams)
+				}
+			}
+		})
+	}
+}
+
+func TestKeepalivePings(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{
+		KeepaliveTime:    100 * time.Millisecond,
+		KeepaliveTimeout: 100 * time.Millisecond,
+	})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	// the pings are Version requests
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+	tester.waitForAltRuntime(t)
+
+	// the idle connection is pinged and stays connected
+	r := tester.proxyServer.interceptors[0].(*RuntimeProxy)
+	time.Sleep(500 * time.Millisecond)
+	if state := r.clients[1].currentState(); state != clientStateConnected {
+		t.Fatalf("alt runtime disconnected while it was alive (state %v)", state)
+	}
+
+	// no requests are made after the runtime stops, so it's
+	// the keepalive ping that detects the dead connection
+	tester.servers[1].Stop()
+	for i := 0; r.clients[1].currentState() == clientStateConnected; i++ {
+		if i == 100 {
+			t.Fatalf("the connection to the stopped runtime wasn't closed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	tester.verifyJournal(t, nil)
+}
+
+func TestMethodFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		allowed, denied  []string
+		noImageService   bool
+		deniedMethods    []string
+		notDeniedMethods []string
+		error            string
+	}{
+		{
+			name:             "no filter",
+			notDeniedMethods: []string{"RuntimeService/ExecSync", "ImageService/PullImage"},
+		},
+		{
+			name:             "denied methods",
+			denied:           []string{"ExecSync", "RuntimeService/Exec"},
+			deniedMethods:    []string{"RuntimeService/ExecSync", "RuntimeService/Exec"},
+			notDeniedMethods: []string{"RuntimeService/Attach", "ImageService/PullImage"},
+		},
+		{
+			name:             "allowed methods",
+			allowed:          []string{"Version", "ImageService/PullImage"},
+			deniedMethods:    []string{"RuntimeService/ExecSync", "RuntimeService/Status"},
+			notDeniedMethods: []string{"RuntimeService/Version", "ImageService/PullImage"},
+		},
+		{
+			name:             "allowed and denied methods",
+			allowed:          []string{"Version", "Status"},
+			denied:           []string{"Status"},
+			deniedMethods:    []string{"RuntimeService/Status", "ImageService/PullImage"},
+			notDeniedMethods: []string{"RuntimeService/Version"},
+		},
+		{
+			name:             "no image service",
+			noImageService:   true,
+			deniedMethods:    []string{"ImageService/PullImage", "ImageService/ListImages", "ImageService/ImageFsInfo"},
+			notDeniedMethods: []string{"RuntimeService/Version", "RuntimeService/ListContainers"},
+		},
+		{
+			name:   "unknown method",
+			denied: []string{"NoSuchMethod"},
+			error:  "unknown CRI method \"NoSuchMethod\"",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := newTestRuntimeProxy([]string{fakeCriSocketPath1, altSocketSpec}, RuntimeProxyOptions{
+				AllowedMethods: tc.allowed,
+				DeniedMethods:  tc.denied,
+				NoImageService: tc.noImageService,
+			})
+			switch {
+			case tc.error == "" && err != nil:
+				t.Fatalf("NewRuntimeProxy(): %v", err)
+			case tc.error != "" && err == nil:
+				t.Fatalf("NewRuntimeProxy() didn't return the expected error")
+			case tc.error != "":
+				if !strings.Contains(err.Error(), tc.error) {
+					t.Errorf("bad error message: %q instead of %q", err.Error(), tc.error)
+				}
+				return
+			}
+			for _, method := range tc.deniedMethods {
+				info := &grpc.UnaryServerInfo{FullMethod: "/runtime." + method}
+				_, err := r.Intercept(context.Background(), &runtimeapi.VersionRequest{}, info, nil)
+				if grpc.Code(err) != codes.Unimplemented {
+					t.Errorf("%s: expected Unimplemented error, got %v", method, err)
+				}
+			}
+			for _, method := range tc.notDeniedMethods {
+				if r.deniedMethods[method] {
+					t.Errorf("%s is unexpectedly denied", method)
+				}
+			}
+		})
+	}
+}
+
+func TestRuntimeApiVersionOverride(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{RuntimeApiVersion: "v1alpha1"})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	tester.verifyCall(t, "/runtime.RuntimeService/Version", &runtimeapi.VersionRequest{},
+		&runtimeapi.VersionResponse{
+			Version:           "0.1.0",
+			RuntimeName:       "criproxy",
+			RuntimeVersion:    version.Version,
+			RuntimeApiVersion: "v1alpha1",
+		}, "")
+	// Version calls are skipped in the journal as the proxy also
+	// makes them in background when connecting to the runtimes
+	tester.verifyJournal(t, nil)
+}
+
+func TestRuntimeNameOverride(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{RuntimeName: "docker"})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	tester.verifyCall(t, "/runtime.RuntimeService/Version", &runtimeapi.VersionRequest{},
+		&runtimeapi.VersionResponse{
+			Version:           "0.1.0",
+			RuntimeName:       "docker",
+			RuntimeVersion:    version.Version,
+			RuntimeApiVersion: "0.1.0",
+		}, "")
+	tester.verifyJournal(t, nil)
+}
+
+func TestImagePullDedup(t *testing.T) {
+	var g pullGroup
+	var calls int32
+	release := make(chan struct{})
+	pullErr := errors.New("pull failed")
+	pull := func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil, pullErr
+	}
+
+	errs := make(chan error, 3)
+	go func() {
+		_, err := g.do(context.Background(), "/image1", pull)
+		errs <- err
+	}()
+	// wait for the first pull to start
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := g.do(context.Background(), "/image1", pull)
+			errs <- err
+		}()
+	}
+	// wait for the waiters to join the pull
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	for i := 0; i < 3; i++ {
+		if err := <-errs; err != pullErr {
+			t.Errorf("pull %d returned %v instead of %v", i, err, pullErr)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("the image was pulled %d times instead of once", n)
+	}
+
+	// the image is pulled again after the previous pull completes
+	resp, err := g.do(context.Background(), "/image1", func(ctx context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return "ok", nil
+	})
+	if err != nil || resp != "ok" {
+		t.Errorf("the second pull returned %v, %v", resp, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("bad pull count %d after the second pull", n)
+	}
+}
+
+func TestImagePullDedupCancel(t *testing.T) {
+	var g pullGroup
+	started := make(chan struct{})
+	release := make(chan struct{})
+	pullCtxs := make(chan context.Context, 1)
+	pull := func(ctx context.Context) (interface{}, error) {
+		pullCtxs <- ctx
+		close(started)
+		select {
+		case <-release:
+			return "ok", nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := g.do(firstCtx, "/image1", pull)
+		firstErr <- err
+	}()
+	<-started
+	pullCtx := <-pullCtxs
+
+	secondResp := make(chan interface{}, 1)
+	go func() {
+		resp, err := g.do(context.Background(), "/image1", pull)
+		if err != nil {
+			t.Errorf("the second caller got an error: %v", err)
+		}
+		secondResp <- resp
+	}()
+	// wait for the second caller to join the pull
+	time.Sleep(100 * time.Millisecond)
+
+	// the first caller stops waiting when its context is
+	// cancelled, but the pull goes on for the second caller
+	cancelFirst()
+	if err := <-firstErr; err != context.Canceled {
+		t.Errorf("the first caller got %v instead of %v", err, context.Canceled)
+	}
+	if pullCtx.Err() != nil {
+		t.Errorf("the pull was cancelled together with the first caller: %v", pullCtx.Err())
+	}
+	close(release)
+	if resp := <-secondResp; resp != "ok" {
+		t.Errorf("the second caller got %v instead of the pull result", resp)
+	}
+
+	// the pull is cancelled when all of the callers give up
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	pullCtxs = make(chan context.Context, 1)
+	if _, err := g.do(ctx, "/image2", func(ctx context.Context) (interface{}, error) {
+		pullCtxs <- ctx
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}); err != context.DeadlineExceeded {
+		t.Errorf("the caller got %v instead of %v", err, context.DeadlineExceeded)
+	}
+	select {
+	case <-(<-pullCtxs).Done():
+	case <-time.After(5 * time.Second):
+		t.Errorf("the pull wasn't cancelled after all of the callers gave up")
+	}
+}
+
+func TestImagePullDedupAuth(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{})
+	defer tester.stop()
+	tester.startServers(t, 0)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+	tester.servers[0].SetFakePullDelay(500 * time.Millisecond)
+
+	// the pulls without credentials are coalesced, while the pull
+	// with the credentials passed by kubelet is made separately
+	reqs := []*runtimeapi.PullImageRequest{
+		{Image: &runtimeapi.ImageSpec{Image: "image1-3"}},
+		{Image: &runtimeapi.ImageSpec{Image: "image1-3"}},
+		{
+			Image: &runtimeapi.ImageSpec{Image: "image1-3"},
+			Auth:  &runtimeapi.AuthConfig{Username: "user", Password: "secret"},
+		},
+	}
+	errs := make(chan error, len(reqs))
+	for _, req := range reqs {
+		go func(req *runtimeapi.PullImageRequest) {
+			errs <- tester.invoke("/runtime.ImageService/PullImage", req, &runtimeapi.PullImageResponse{})
+		}(req)
+	}
+	for range reqs {
+		if err := <-errs; err != nil {
+			t.Errorf("PullImage(): %v", err)
+		}
+	}
+	tester.verifyJournal(t, []string{"1/image/PullImage", "1/image/PullImage"})
+}
+
+func TestRemoveImageByDigest(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+	tester.waitForAltRuntime(t)
+
+	// the image ids that are digests aren't prefixed, so the
+	// same image may be present in both runtimes
+	imageId := digest.FromString("image").String()
+	tester.servers[0].SetFakeImages([]string{imageId, "image1-1"})
+	tester.servers[1].SetFakeImages([]string{imageId, "image2-1"})
+	tester.verifyCall(t, "/runtime.ImageService/RemoveImage",
+		&runtimeapi.RemoveImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: imageId},
+		},
+		&runtimeapi.RemoveImageResponse{}, "")
+	tester.verifyJournal(t, []string{"1/image/RemoveImage", "2/image/RemoveImage"})
+
+	tester.verifyCall(t, "/runtime.ImageService/ListImages",
+		&runtimeapi.ListImagesRequest{},
+		&runtimeapi.ListImagesResponse{
+			Images: []*runtimeapi.Image{
+				{
+					Id:       "image1-1",
+					RepoTags: []string{"image1-1"},
+					Size_:    fakeImageSize1,
+				},
+				{
+					Id:       "alt/image2-1",
+					RepoTags: []string{"alt/image2-1"},
+					Size_:    fakeImageSize2,
+				},
+			},
+		}, "")
+	tester.verifyJournal(t, []string{"1/image/ListImages", "2/image/ListImages"})
+
+	// a prefixed image is only removed from its own runtime
+	tester.verifyCall(t, "/runtime.ImageService/RemoveImage",
+		&runtimeapi.RemoveImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "alt/image2-1"},
+		},
+		&runtimeapi.RemoveImageResponse{}, "")
+	tester.verifyJournal(t, []string{"2/image/RemoveImage"})
+}
+
+func TestRemoveImageByDigestWithOfflineRuntime(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{})
+	defer tester.stop()
+	tester.startServers(t, 0)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	// the image is removed from the primary runtime, but the
+	// removal can't be confirmed for the offline one
+	imageId := digest.FromString("image").String()
+	tester.servers[0].SetFakeImages([]string{imageId})
+	tester.verifyCall(t, "/runtime.ImageService/RemoveImage",
+		&runtimeapi.RemoveImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: imageId},
+		},
+		&runtimeapi.RemoveImageResponse{}, `runtime "alt" is not available`)
+	tester.verifyJournal(t, []string{"1/image/RemoveImage"})
+}
+
+func TestRegistryAuth(t *testing.T) {
+	_, err := newTestRuntimeProxy([]string{fakeCriSocketPath1, altSocketSpec}, RuntimeProxyOptions{
+		RegistryAuth: map[string]*RegistryAuth{"nosuchruntime": {Username: "user"}},
+	})
+	if err == nil {
+		t.Errorf("NewRuntimeProxy() didn't fail for registry credentials of unknown runtime")
+	}
+
+	r, err := newTestRuntimeProxy([]string{fakeCriSocketPath1, altSocketSpec}, RuntimeProxyOptions{
+		RegistryAuth: map[string]*RegistryAuth{
+			"alt": {Username: "altuser", Password: "altpass", ServerAddress: "registry.example.com"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRuntimeProxy(): %v", err)
+	}
+	for _, tc := range []struct {
+		name, image  string
+		auth         *runtimeapi.AuthConfig
+		expectedAuth *runtimeapi.AuthConfig
+	}{
+		{
+			name:  "primary runtime",
+			image: "image1-3",
+		},
+		{
+			name:  "runtime with credentials",
+			image: "alt/image2-3",
+			expectedAuth: &runtimeapi.AuthConfig{
+				Username:      "altuser",
+				Password:      "altpass",
+				ServerAddress: "registry.example.com",
+			},
+		},
+		{
+			name:         "credentials passed by kubelet",
+			image:        "alt/image2-3",
+			auth:         &runtimeapi.AuthConfig{Username: "kubeletuser", Password: "kubeletpass"},
+			expectedAuth: &runtimeapi.AuthConfig{Username: "kubeletuser", Password: "kubeletpass"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			inner := &runtimeapi.PullImageRequest{
+				Image: &runtimeapi.ImageSpec{Image: tc.image},
+				Auth:  tc.auth,
+			}
+			req, _, err := r.criVersion.WrapObject(inner)
+			if err != nil {
+				t.Fatalf("WrapObject(): %v", err)
+			}
+			client, _, err := r.routeImage(tc.image)
+			if err != nil {
+				t.Fatalf("routeImage(): %v", err)
+			}
+			r.addRegistryAuth(client, req.(PullImageRequest))
+			if !reflect.DeepEqual(inner.Auth, tc.expectedAuth) {
+				t.Errorf("bad auth: %#v instead of %#v", inner.Auth, tc.expectedAuth)
+			}
+		})
+	}
+}
+
+func TestWaitForRuntimes(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{})
+	defer tester.stop()
+	tester.startServers(t, -1)
+
+	r := tester.proxyServer.interceptors[0].(*RuntimeProxy)
+	if err := r.WaitForRuntimes(); err != nil {
+		t.Fatalf("WaitForRuntimes(): %v", err)
+	}
+	for _, client := range r.clients {
+		if client.currentState() != clientStateConnected {
+			t.Errorf("runtime %q is not connected", client.getID())
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	// make the request exceed gRPC's default max message
+	// size of 4 MiB
+	listReq := &runtimeapi.ListImagesRequest{
+		Filter: &runtimeapi.ImageFilter{
+			Image: &runtimeapi.ImageSpec{Image: strings.Repeat("x", 5*1024*1024)},
+		},
+	}
+	for _, tc := range []struct {
+		name           string
+		maxMessageSize int
+		expectError    bool
+	}{
+		{
+			name:        "default max message size",
+			expectError: true,
+		},
+		{
+			name:           "increased max message size",
+			maxMessageSize: 16 * 1024 * 1024,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+				proxytest.NewFakeCriServer19,
+				proxytest.NewFakeCriServer19,
+			}, RuntimeProxyOptions{MaxMessageSize: tc.maxMessageSize})
+			defer tester.stop()
+			tester.startServers(t, 0)
+			tester.startProxy(t)
+			tester.connectToProxy(t)
+
+			var resp runtimeapi.ListImagesResponse
+			err := tester.invoke("/runtime.ImageService/ListImages", listReq, &resp)
+			switch {
+			case tc.expectError && err == nil:
+				t.Errorf("ListImages() didn't fail with the default max message size")
+			case !tc.expectError && err != nil:
+				t.Errorf("ListImages() failed: %v", err)
+			case !tc.expectError && len(resp.Images) != 0:
+				t.Errorf("unexpected images in the response: %v", resp.Images)
+			}
+		})
+	}
+}
+
+func waitForRuntimeHealth(t *testing.T, r *RuntimeProxy, expectedHealthy map[string]bool) {
+	for i := 0; ; i++ {
+		health := r.RuntimeHealth()
+		matches := len(health) == len(expectedHealthy)
+		for id, healthy := range expectedHealthy {
+			if err, found := health[id]; !found || (err == nil) != healthy {
+				matches = false
+			}
+		}
+		if matches {
+			return
+		}
+		if i == 100 {
+			t.Fatalf("runtime health didn't match %v: %v", expectedHealthy, health)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{
+		HealthCheckInterval:      200 * time.Millisecond,
+		HealthCheckRetryInterval: 50 * time.Millisecond,
+	})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+
+	r := tester.proxyServer.interceptors[0].(*RuntimeProxy)
+	if health := r.RuntimeHealth(); health != nil {
+		t.Errorf("health checks were made before the first request: %v", health)
+	}
+
+	// the first request starts the health checks
+	var resp runtimeapi.StatusResponse
+	if err := tester.invoke("/runtime.RuntimeService/Status", &runtimeapi.StatusRequest{}, &resp); err != nil {
+		t.Fatalf("Status(): %v", err)
+	}
+	waitForRuntimeHealth(t, r, map[string]bool{"": true, "alt": true})
+
+	// Status is served from the cache
+	cached := r.health.cachedStatus("")
+	if cached == nil {
+		t.Fatalf("no cached status for the primary runtime")
+	}
+	if err := tester.invoke("/runtime.RuntimeService/Status", &runtimeapi.StatusRequest{}, &resp); err != nil {
+		t.Fatalf("Status(): %v", err)
+	}
+	if !reflect.DeepEqual(&resp, cached.Unwrap()) {
+		t.Errorf("bad status: %#v instead of %#v", &resp, cached.Unwrap())
+	}
+
+	tester.servers[1].Stop()
+	waitForRuntimeHealth(t, r, map[string]bool{"": true, "alt": false})
+}
+
+func TestParseRuntimeAddr(t *testing.T) {
+	for _, tc := range []struct {
+		addr, id, path string
+	}{
+		{"/var/run/dockershim.sock", "", "/var/run/dockershim.sock"},
+		{"alt:/var/run/another.sock", "alt", "/var/run/another.sock"},
+		{"tcp://10.0.0.5:9000", "", "tcp://10.0.0.5:9000"},
+		{"remote:tcp://10.0.0.5:9000", "remote", "tcp://10.0.0.5:9000"},
+	} {
+		if id, path := ParseRuntimeAddr(tc.addr); id != tc.id || path != tc.path {
+			t.Errorf("ParseRuntimeAddr(%q) = %q, %q instead of %q, %q", tc.addr, id, path, tc.id, tc.path)
+		}
+	}
+}
+
+func TestFixStreamingUrl(t *testing.T) {
+	for _, tc := range []struct {
+		streamUrl, url, expected string
+	}{
+		{"http://10.0.0.5:11250/", "/cri/exec/94B_NhGa", "http://10.0.0.5:11250/cri/exec/94B_NhGa"},
+		{"http://[fd00::5]:11250/", "/cri/exec/94B_NhGa", "http://[fd00::5]:11250/cri/exec/94B_NhGa"},
+		{"http://[fd00::5]:11250/", "//[::]:35057/cri/exec/tb8rgDBh", "//[::]:35057/cri/exec/tb8rgDBh"},
+		{"http://[fd00::5]:11250/", "http://[fd00::6]:10010/exec/abc", "http://[fd00::6]:10010/exec/abc"},
+	} {
+		streamUrl, err := url.Parse(tc.streamUrl)
+		if err != nil {
+			t.Fatalf("error parsing stream url: %v", err)
+		}
+		r, err := NewRuntimeProxy(&CRI19{}, []string{fakeCriSocketPath1}, connectionTimeoutForTests, streamUrl, RuntimeProxyOptions{})
+		if err != nil {
+			t.Fatalf("NewRuntimeProxy(): %v", err)
+		}
+		if fixed := r.fixStreamingUrl(tc.url); fixed != tc.expected {
+			t.Errorf("fixStreamingUrl(%q) with stream url %q = %q instead of %q", tc.url, tc.streamUrl, fixed, tc.expected)
+		}
+	}
+}
+
+func TestRegistryMirrors(t *testing.T) {
+	mirrors, err := newRegistryMirrors(map[string]string{
+		"docker.io":         "mirror.example.com:5000",
+		"docker.io/library": "library-mirror.example.com/",
+		"gcr.io":            "gcr-mirror.example.com:5000",
+	})
+	if err != nil {
+		t.Fatalf("newRegistryMirrors(): %v", err)
+	}
+	for _, tc := range []struct {
+		image, mirrored string
+	}{
+		{"docker.io/foo/bar:1.0", "mirror.example.com:5000/foo/bar:1.0"},
+		{"docker.io/library/nginx", "library-mirror.example.com/nginx"},
+		{"gcr.io/google_containers/pause:3.1", "gcr-mirror.example.com:5000/google_containers/pause:3.1"},
+		{"docker.iox/foo", "docker.iox/foo"},
+		{"nginx", "nginx"},
+	} {
+		if mirrored := mirrors.rewrite(tc.image); mirrored != tc.mirrored {
+			t.Errorf("rewrite(%q) = %q instead of %q", tc.image, mirrored, tc.mirrored)
+		}
+		if image := mirrors.restore(tc.mirrored); image != tc.image {
+			t.Errorf("restore(%q) = %q instead of %q", tc.mirrored, image, tc.image)
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		mirrors map[string]string
+	}{
+		{
+			name:    "empty mirror",
+			mirrors: map[string]string{"docker.io": ""},
+		},
+		{
+			name: "same mirror for different prefixes",
+			mirrors: map[string]string{
+				"docker.io": "mirror.example.com:5000",
+				"gcr.io":    "mirror.example.com:5000/",
+			},
+		},
+		{
+			name: "nested mirrors",
+			mirrors: map[string]string{
+				"docker.io": "mirror.example.com:5000",
+				"gcr.io":    "mirror.example.com:5000/gcr",
+			},
+		},
+	} {
+		if _, err := newRegistryMirrors(tc.mirrors); err == nil {
+			t.Errorf("newRegistryMirrors() didn't fail for %s", tc.name)
+		}
+	}
+}
+
+func TestRegistryMirrorRoundTrip(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{
+		RegistryMirrors: map[string]string{"docker.io": "mirror.example.com:5000"},
+	})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+	tester.waitForAltRuntime(t)
+
+	// the runtime only knows the mirrored name, so the image can
+	// only be found if all of the requests are rewritten
+	image := "alt/docker.io/foo/bar:1.0"
+	expectedImage := &runtimeapi.Image{
+		Id:       image,
+		RepoTags: []string{image},
+		Size_:    fakeImageSize2,
+	}
+	tester.verifyCall(t, "/runtime.ImageService/PullImage", &runtimeapi.PullImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: image},
+	}, &runtimeapi.PullImageResponse{ImageRef: image}, "")
+	tester.verifyCall(t, "/runtime.ImageService/ImageStatus", &runtimeapi.ImageStatusRequest{
+		Image: &runtimeapi.ImageSpec{Image: image},
+	}, &runtimeapi.ImageStatusResponse{Image: expectedImage}, "")
+	tester.verifyCall(t, "/runtime.ImageService/ListImages", &runtimeapi.ListImagesRequest{
+		Filter: &runtimeapi.ImageFilter{Image: &runtimeapi.ImageSpec{Image: image}},
+	}, &runtimeapi.ListImagesResponse{Images: []*runtimeapi.Image{expectedImage}}, "")
+	tester.verifyJournal(t, []string{"2/image/PullImage", "2/image/ImageStatus", "2/image/ListImages"})
+
+	var resp runtimeapi.ListImagesResponse
+	if err := tester.invoke("/runtime.ImageService/ListImages", &runtimeapi.ListImagesRequest{}, &resp); err != nil {
+		t.Fatalf("ListImages(): %v", err)
+	}
+	found := false
+	for _, img := range resp.GetImages() {
+		if reflect.DeepEqual(img, expectedImage) {
+			found = true
+		}
+		for _, tag := range img.RepoTags {
+			if strings.Contains(tag, "mirror.example.com") {
+				t.Errorf("mirrored image name %q returned by ListImages", tag)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("image %q not returned by ListImages", image)
+	}
+	tester.verifyJournal(t, []string{"1/image/ListImages", "2/image/ListImages"})
+}
+
+func TestBadBackendTLS(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		backendTLS map[string]*BackendTLS
+		error      string
+	}{
+		{
+			name:       "unix socket runtime",
+			backendTLS: map[string]*BackendTLS{"alt": {}},
+			error:      "TLS is specified for runtime \"alt\"",
+		},
+		{
+			name:       "unknown runtime",
+			backendTLS: map[string]*BackendTLS{"nosuchruntime": {}},
+			error:      "runtime \"nosuchruntime\" with TLS settings",
+		},
+		{
+			name:       "missing certificate",
+			backendTLS: map[string]*BackendTLS{"remote": {CertFile: "/no/such/cert.pem", KeyFile: "/no/such/key.pem"}},
+			error:      "bad TLS settings for runtime \"remote\"",
+		},
+		{
+			name:       "certificate without key",
+			backendTLS: map[string]*BackendTLS{"remote": {CertFile: "/no/such/cert.pem"}},
+			error:      "both certFile and keyFile must be specified",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newTestRuntimeProxy([]string{fakeCriSocketPath1, altSocketSpec, "remote:tcp://127.0.0.1:9000"}, RuntimeProxyOptions{
+				BackendTLS: tc.backendTLS,
+			})
+			switch {
+			case err == nil:
+				t.Errorf("NewRuntimeProxy() didn't fail")
+			case !strings.Contains(err.Error(), tc.error):
+				t.Errorf("bad error message: %q doesn't contain %q", err.Error(), tc.error)
+			}
+		})
+	}
+}
+
+// makeTestCert makes a self-signed certificate for 127.0.0.1 and
+// writes it to a PEM file in dir
+func makeTestCert(t *testing.T, dir string) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "criproxy-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate(): %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+func TestBackendTLSHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "criproxy-tls")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	cert, caFile := makeTestCert(t, dir)
+
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{Certificates: []tls.Certificate{cert}})))
+	journal := proxytest.NewSimpleJournal()
+	runtimeapi.RegisterRuntimeServiceServer(server, proxytest.NewFakeRuntimeServer19(journal, ""))
+	runtimeapi.RegisterImageServiceServer(server, proxytest.NewFakeImageServer19(journal))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	go server.Serve(ln)
+	defer server.Stop()
+
+	addr := "tcp://" + ln.Addr().String()
+	for _, tc := range []struct {
+		name, serverName string
+		expectError      bool
+	}{
+		{
+			name: "server name from the address",
+		},
+		{
+			name:       "matching server name override",
+			serverName: "127.0.0.1",
+		},
+		{
+			name:        "mismatching server name override",
+			serverName:  "wrong.example.com",
+			expectError: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &BackendTLS{CAFile: caFile, ServerName: tc.serverName}
+			creds, err := b.credentials(addr)
+			if err != nil {
+				t.Fatalf("credentials(): %v", err)
+			}
+			conn, err := utils.Dial(addr, time.Second)
+			if err != nil {
+				t.Fatalf("Dial(): %v", err)
+			}
+			defer conn.Close()
+			// gRPC passes the address as is to the handshake
+			_, _, err = creds.ClientHandshake(context.Background(), addr, conn)
+			switch {
+			case tc.expectError && err == nil:
+				t.Errorf("TLS handshake didn't fail")
+			case !tc.expectError && err != nil:
+				t.Errorf("TLS handshake failed: %v", err)
+			}
+		})
+	}
+
+	r, err := NewRuntimeProxy(&CRI19{}, []string{fakeCriSocketPath1, "remote:" + addr}, time.Second, testStreamUrl(), RuntimeProxyOptions{
+		BackendTLS: map[string]*BackendTLS{
+			"remote": {CAFile: caFile},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRuntimeProxy(): %v", err)
+	}
+	defer r.Stop()
+	if err := <-r.clientById("remote").connect(); err != nil {
+		t.Errorf("error connecting to the runtime: %v", err)
+	}
+}
+
+func TestImageFsDedup(t *testing.T) {
+	fs1 := proxytest.MakeFakeImageFsUsage19(imageFsUUID1)
+	fs2 := proxytest.MakeFakeImageFsUsage19(imageFsUUID2)
+	fs1dup := proxytest.MakeFakeImageFsUsage19(imageFsUUID1)
+	noId := &runtimeapi.FilesystemUsage{}
+	var items []CRIObject
+	for _, fs := range []*runtimeapi.FilesystemUsage{fs1, fs2, fs1dup, noId, noId} {
+		items = append(items, &FilesystemUsage_19{fs})
+	}
+	var result []*runtimeapi.FilesystemUsage
+	for _, item := range dedupFilesystems(items) {
+		result = append(result, item.Unwrap().(*runtimeapi.FilesystemUsage))
+	}
+	expected := []*runtimeapi.FilesystemUsage{fs1, fs2, noId, noId}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("bad dedup result: %v instead of %v", result, expected)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{
+		RateLimits: map[string]RateLimit{"ImageStatus": {Rate: 0.001, Burst: 2}},
+	})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	for i := 0; i < 3; i++ {
+		var resp runtimeapi.ImageStatusResponse
+		err := tester.invoke("/runtime.ImageService/ImageStatus", &runtimeapi.ImageStatusRequest{
+			Image: &runtimeapi.ImageSpec{Image: "image1-1"},
+		}, &resp)
+		switch {
+		case i < 2 && err != nil:
+			t.Errorf("ImageStatus() #%d failed: %v", i, err)
+		case i == 2 && grpc.Code(err) != codes.ResourceExhausted:
+			t.Errorf("expected ResourceExhausted error, got %v", err)
+		}
+	}
+	tester.verifyJournal(t, []string{"1/image/ImageStatus", "1/image/ImageStatus"})
+}
+
+func TestBadRateLimits(t *testing.T) {
+	for _, limits := range []map[string]RateLimit{
+		{"NoSuchMethod": {Rate: 1}},
+		{"ListContainers": {Rate: 0}},
+	} {
+		if _, err := newTestRuntimeProxy([]string{fakeCriSocketPath1, altSocketSpec}, RuntimeProxyOptions{RateLimits: limits}); err == nil {
+			t.Errorf("NewRuntimeProxy() didn't fail for rate limits %v", limits)
+		}
+	}
+}
+
+func TestBackends(t *testing.T) {
+	r, err := newTestRuntimeProxy([]string{fakeCriSocketPath1, altSocketSpec}, RuntimeProxyOptions{DefaultRuntime: "alt"})
+	if err != nil {
+		t.Fatalf("NewRuntimeProxy(): %v", err)
+	}
+	expected := []BackendInfo{
+		{
+			ImagePrefix: "primary/",
+			Endpoint:    fakeCriSocketPath1,
+			State:       "offline",
+		},
+		{
+			Id:          "alt",
+			Default:     true,
+			ImagePrefix: "alt/",
+			IdPrefix:    "alt__",
+			Endpoint:    fakeCriSocketPath2,
+			State:       "offline",
+		},
+	}
+	if backends := r.Backends(); !reflect.DeepEqual(backends, expected) {
+		t.Errorf("bad backend list: %#v instead of %#v", backends, expected)
+	}
+}
+
+// findMetric returns the metric with the specified name and labels
+// from the default prometheus registry or nil if there's no such
+// metric
+func findMetric(t *testing.T, name string, labels map[string]string) *dto.Metric {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("error gathering the metrics: %v", err)
+	}
+	for _, mf := range families {
+		if mf.GetName() != name {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			metricLabels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				metricLabels[l.GetName()] = l.GetValue()
+			}
+			if reflect.DeepEqual(metricLabels, labels) {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func TestPullMetrics(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{PullImageSizeMetrics: true})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	pullDelay := 300 * time.Millisecond
+	tester.servers[0].SetFakePullDelay(pullDelay)
+	tester.verifyCall(t, "/runtime.ImageService/PullImage",
+		&runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "registry.example.com:5000/foo/bar"},
+		},
+		&runtimeapi.PullImageResponse{ImageRef: "registry.example.com:5000/foo/bar"}, "")
+	tester.verifyJournal(t, []string{"1/image/PullImage", "1/image/ImageStatus"})
+
+	labels := map[string]string{"runtime": "primary", "registry": "registry.example.com:5000"}
+	duration := findMetric(t, "criproxy_image_pull_duration_seconds", labels)
+	switch {
+	case duration == nil:
+		t.Errorf("pull duration not recorded")
+	case duration.GetHistogram().GetSampleCount() != 1:
+		t.Errorf("bad pull count %d in the histogram", duration.GetHistogram().GetSampleCount())
+	case duration.GetHistogram().GetSampleSum() < pullDelay.Seconds():
+		t.Errorf("pull duration %v is less than the pull delay", duration.GetHistogram().GetSampleSum())
+	}
+
+	size := findMetric(t, "criproxy_pulled_image_size_bytes", labels)
+	switch {
+	case size == nil:
+		t.Errorf("pulled image size not recorded")
+	case size.GetSummary().GetSampleSum() != float64(fakeImageSize1):
+		t.Errorf("bad pulled image size %v", size.GetSummary().GetSampleSum())
+	}
+}
+
+func TestRegistryLabel(t *testing.T) {
+	for _, tc := range []struct {
+		image, registry string
+	}{
+		{"nginx", "docker.io"},
+		{"foo/bar:1.0", "docker.io"},
+		{"docker.io/foo/bar", "docker.io"},
+		{"gcr.io/google_containers/pause:3.1", "gcr.io"},
+		{"localhost/foo", "localhost"},
+		{"registry:5000/foo", "registry:5000"},
+	} {
+		if registry := registryLabel(tc.image); registry != tc.registry {
+			t.Errorf("registryLabel(%q) = %q instead of %q", tc.image, registry, tc.registry)
+		}
+	}
+}
+
+func TestBuildInfoMetrics(t *testing.T) {
+	if m := findMetric(t, "criproxy_build_info", map[string]string{"version": version.Version, "commit": version.Commit}); m == nil || m.GetGauge().GetValue() != 1 {
+		t.Errorf("bad build info metric %v", m)
+	}
+	m := findMetric(t, "criproxy_start_time_seconds", map[string]string{})
+	switch {
+	case m == nil:
+		t.Errorf("start time not recorded")
+	case m.GetGauge().GetValue() > float64(time.Now().Unix()+1) || m.GetGauge().GetValue() <= 0:
+		t.Errorf("bad start time %v", m.GetGauge().GetValue())
+	}
+}
+
+func TestObserve(t *testing.T) {
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{Observe: true})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	// the image that would be routed to the alt runtime is passed
+	// to the primary one as-is
+	tester.verifyCall(t, "/runtime.ImageService/PullImage",
+		&runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: "alt/image-observe"},
+		},
+		&runtimeapi.PullImageResponse{ImageRef: "alt/image-observe"}, "")
+	tester.verifyJournal(t, []string{"1/image/PullImage"})
+
+	m := findMetric(t, "criproxy_observed_routes_total", map[string]string{
+		"method":      "ImageService/PullImage",
+		"actual":      "primary",
+		"would_route": "alt",
+	})
+	if m == nil || m.GetCounter().GetValue() != 1 {
+		t.Errorf("bad observed route metric %v", m)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	oldAuthRequest := trace.AuthRequest
+	defer func() {
+		tracingEnabled = false
+		trace.AuthRequest = oldAuthRequest
+	}()
+
+	tester := newProxyTester(t, altSocketSpec, []makeFakeCriServerFunc{
+		proxytest.NewFakeCriServer19,
+		proxytest.NewFakeCriServer19,
+	}, RuntimeProxyOptions{})
+	defer tester.stop()
+	tester.startServers(t, -1)
+	tester.startProxy(t)
+	tester.connectToProxy(t)
+	tester.skipJournalItems("1/runtime/Version", "2/runtime/Version")
+
+	getTraces := func(remoteAddr string) (int, string) {
+		req := httptest.NewRequest("GET", "/debug/requests?fam="+traceFamily+"&b=0&exp=1", nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		TraceHandler(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	EnableTracing(false)
+	tester.verifyCall(t, "/runtime.ImageService/ImageStatus",
+		&runtimeapi.ImageStatusRequest{
+			Image: &runtimeapi.ImageSpec{Image: "image-traced"},
+		},
+		&runtimeapi.ImageStatusResponse{}, "")
+	tester.verifyJournal(t, []string{"1/image/ImageStatus"})
+
+	code, body := getTraces("127.0.0.1:4242")
+	if code != http.StatusOK {
+		t.Fatalf("local request for the traces failed with status %d", code)
+	}
+	for _, expected := range []string{"/runtime.ImageService/ImageStatus", "image: image-traced", "-&gt; primary: /runtime.ImageService/ImageStatus"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("the traces don't contain %q:\n%s", expected, body)
+		}
+	}
+	if code, _ := getTraces("192.0.2.1:4242"); code != http.StatusUnauthorized {
+		t.Errorf("remote request for the traces returned status %d instead of %d", code, http.StatusUnauthorized)
+	}
+
+	EnableTracing(true)
+	code, body = getTraces("192.0.2.1:4242")
+	if code != http.StatusOK {
+		t.Fatalf("remote request for the traces failed with status %d", code)
+	}
+	if strings.Contains(body, "image-traced") {
+		t.Errorf("the traces served to a remote host aren't redacted:\n%s", body)
+	}
+	if code, body := getTraces("127.0.0.1:4242"); code != http.StatusOK || !strings.Contains(body, "image: image-traced") {
+		t.Errorf("the traces aren't served in full to localhost (status %d):\n%s", code, body)
+	}
+}
+
+func TestHandleErrorKeepsCode(t *testing.T) {
+	c := newClientConnection(fakeCriSocketPath2, connectionTimeoutForTests, nil)
+	err := c.handleError(grpc.Errorf(codes.Unimplemented, "UpdateContainerResources is not supported"), false)
+	if grpc.Code(err) != codes.Unimplemented {
+		t.Errorf("bad error code %v instead of %v", grpc.Code(err), codes.Unimplemented)
+	}
+	if !strings.Contains(grpc.ErrorDesc(err), fakeCriSocketPath2) || !strings.Contains(grpc.ErrorDesc(err), "is not supported") {
+		t.Errorf("bad error message %q", grpc.ErrorDesc(err))
+	}
 }
 
 func init() {
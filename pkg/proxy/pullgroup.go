@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// pullCall denotes an image pull that's in progress
+type pullCall struct {
+	done    chan struct{}
+	resp    interface{}
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// pullGroup coalesces concurrent pulls of the same image so that
+// only one of them is passed to the runtime while the others wait
+// for its result.
+type pullGroup struct {
+	sync.Mutex
+	calls map[string]*pullCall
+}
+
+// do invokes pull unless there's a pull with the same key already in
+// progress, in which case it waits for that pull to complete and
+// returns its result. The key is forgotten as soon as the pull
+// completes, so the subsequent calls invoke pull again.
+//
+// The pull runs on its own context that's not tied to the context of
+// any caller, so that a caller that gives up doesn't make the pull
+// fail for the others. Each caller stops waiting when its own ctx is
+// done. The pull's context is cancelled only when all of the callers
+// have given up.
+func (g *pullGroup) do(ctx context.Context, key string, pull func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*pullCall)
+	}
+	c, found := g.calls[key]
+	if !found {
+		pullCtx, cancel := context.WithCancel(context.Background())
+		c = &pullCall{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+		go func() {
+			c.resp, c.err = pull(pullCtx)
+			g.Lock()
+			g.forget(key, c)
+			g.Unlock()
+			cancel()
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	g.Unlock()
+
+	select {
+	case <-c.done:
+		return c.resp, c.err
+	case <-ctx.Done():
+		g.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			// nobody is interested in the result anymore
+			g.forget(key, c)
+			c.cancel()
+		}
+		g.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// forget removes the call from the group unless it has been
+// replaced by another call with the same key already. It must be
+// called with the group locked.
+func (g *pullGroup) forget(key string, c *pullCall) {
+	if g.calls[key] == c {
+		delete(g.calls, key)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// RateLimit denotes the max rate of the requests for a CRI method
+// that are passed to each runtime.
+type RateLimit struct {
+	// Rate is the number of requests per second.
+	Rate float64
+	// Burst is the max number of requests that can be made at once.
+	Burst int
+}
+
+// rateLimiter is a token bucket rate limiter
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	burst := float64(limit.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token from the bucket and returns true if there's one
+func (l *rateLimiter) allow() bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// makeRateLimiters makes a set of rate limiters for a runtime
+// keyed by dispatch table keys
+func makeRateLimiters(limits map[string]RateLimit) (map[string]*rateLimiter, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	limiters := make(map[string]*rateLimiter)
+	for method, limit := range limits {
+		key, err := dispatchTableKey(method)
+		if err != nil {
+			return nil, err
+		}
+		if limit.Rate <= 0 {
+			return nil, fmt.Errorf("bad rate limit for %q: the rate must be positive", method)
+		}
+		limiters[key] = newRateLimiter(limit)
+	}
+	return limiters, nil
+}
+
+// checkRateLimit returns ResourceExhausted error if the rate limit
+// for the method is exceeded
+func checkRateLimit(limiters map[string]*rateLimiter, c client, method string) error {
+	if limiters == nil {
+		return nil
+	}
+	// method is /package.Service/Method
+	key := method[strings.LastIndex(method, ".")+1:]
+	limiter := limiters[key]
+	if limiter == nil || limiter.allow() {
+		return nil
+	}
+	rateLimitedRequests.WithLabelValues(runtimeLabel(c), key).Inc()
+	return grpc.Errorf(codes.ResourceExhausted, "criproxy: rate limit exceeded for %s on runtime %q", key, c.getID())
+}
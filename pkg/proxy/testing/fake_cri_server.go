@@ -21,6 +21,7 @@ import (
 	"net"
 	"os"
 	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
 
@@ -34,8 +35,10 @@ type FakeCriServer interface {
 	Stop()
 	SetFakeImages(images []string)
 	SetFakeImageSize(size uint64)
+	SetFakePullDelay(delay time.Duration)
 	SetFakeContainerStats(containerId, containerName, imageFsUUID string) interface{}
 	SetFakeFilesystemUsage(imageFsUUID string) interface{}
+	SetFakeStatsUnimplemented(unimplemented bool)
 	CurrentTime() int64
 }
 
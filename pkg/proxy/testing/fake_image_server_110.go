@@ -35,6 +35,7 @@ type FakeImageServer110 struct {
 
 	journal       Journal
 	FakeImageSize uint64
+	FakePullDelay time.Duration
 	Images        map[string]*runtimeapi.Image
 
 	FakeFilesystemUsage []*runtimeapi.FilesystemUsage
@@ -66,6 +67,13 @@ func (r *FakeImageServer110) SetFakeFilesystemUsage(usage []*runtimeapi.Filesyst
 	r.FakeFilesystemUsage = usage
 }
 
+func (r *FakeImageServer110) SetFakePullDelay(delay time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.FakePullDelay = delay
+}
+
 func NewFakeImageServer110(journal Journal) *FakeImageServer110 {
 	return &FakeImageServer110{
 		journal: journal,
@@ -142,6 +150,12 @@ func (r *FakeImageServer110) ImageStatus(ctx context.Context, in *runtimeapi.Ima
 }
 
 func (r *FakeImageServer110) PullImage(ctx context.Context, in *runtimeapi.PullImageRequest) (*runtimeapi.PullImageResponse, error) {
+	r.Lock()
+	delay := r.FakePullDelay
+	r.Unlock()
+	// simulate a slow pull without blocking the other requests
+	time.Sleep(delay)
+
 	r.Lock()
 	defer r.Unlock()
 
@@ -35,6 +35,7 @@ type FakeImageServer19 struct {
 
 	journal       Journal
 	FakeImageSize uint64
+	FakePullDelay time.Duration
 	Images        map[string]*runtimeapi.Image
 
 	FakeFilesystemUsage []*runtimeapi.FilesystemUsage
@@ -66,6 +67,13 @@ func (r *FakeImageServer19) SetFakeFilesystemUsage(usage []*runtimeapi.Filesyste
 	r.FakeFilesystemUsage = usage
 }
 
+func (r *FakeImageServer19) SetFakePullDelay(delay time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.FakePullDelay = delay
+}
+
 func NewFakeImageServer19(journal Journal) *FakeImageServer19 {
 	return &FakeImageServer19{
 		journal: journal,
@@ -142,6 +150,12 @@ func (r *FakeImageServer19) ImageStatus(ctx context.Context, in *runtimeapi.Imag
 }
 
 func (r *FakeImageServer19) PullImage(ctx context.Context, in *runtimeapi.PullImageRequest) (*runtimeapi.PullImageResponse, error) {
+	r.Lock()
+	delay := r.FakePullDelay
+	r.Unlock()
+	// simulate a slow pull without blocking the other requests
+	time.Sleep(delay)
+
 	r.Lock()
 	defer r.Unlock()
 
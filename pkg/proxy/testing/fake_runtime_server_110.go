@@ -43,6 +43,8 @@ import (
 
 	runtimeapi "github.com/Mirantis/criproxy/pkg/runtimeapis/v1_12"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 func BuildContainerName110(metadata *runtimeapi.ContainerMetadata, sandboxID string) string {
@@ -76,6 +78,9 @@ type FakeRuntimeServer110 struct {
 	Containers         map[string]*FakeContainer110
 	Sandboxes          map[string]*FakePodSandbox110
 	FakeContainerStats map[string]*runtimeapi.ContainerStats
+	// StatsUnimplemented makes ListContainerStats fail with
+	// Unimplemented error
+	StatsUnimplemented bool
 }
 
 var _ runtimeapi.RuntimeServiceServer = &FakeRuntimeServer110{}
@@ -110,6 +115,13 @@ func (r *FakeRuntimeServer110) SetFakeContainerStats(containerStats []*runtimeap
 	}
 }
 
+func (r *FakeRuntimeServer110) SetFakeStatsUnimplemented(unimplemented bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.StatsUnimplemented = unimplemented
+}
+
 func NewFakeRuntimeServer110(journal Journal, streamUrl string) *FakeRuntimeServer110 {
 	ready := true
 	runtimeReadyStr := runtimeapi.RuntimeReady
@@ -440,6 +452,9 @@ func (r *FakeRuntimeServer110) ListContainerStats(ctx context.Context, in *runti
 	defer r.Unlock()
 
 	r.journal.Record("ListContainerStats")
+	if r.StatsUnimplemented {
+		return nil, grpc.Errorf(codes.Unimplemented, "container stats are not implemented")
+	}
 
 	var result []*runtimeapi.ContainerStats
 	for _, c := range r.Containers {
@@ -43,6 +43,8 @@ import (
 
 	runtimeapi "github.com/Mirantis/criproxy/pkg/runtimeapis/v1_9"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 func BuildContainerName19(metadata *runtimeapi.ContainerMetadata, sandboxID string) string {
@@ -76,6 +78,9 @@ type FakeRuntimeServer19 struct {
 	Containers         map[string]*FakeContainer19
 	Sandboxes          map[string]*FakePodSandbox19
 	FakeContainerStats map[string]*runtimeapi.ContainerStats
+	// StatsUnimplemented makes ListContainerStats fail with
+	// Unimplemented error
+	StatsUnimplemented bool
 }
 
 var _ runtimeapi.RuntimeServiceServer = &FakeRuntimeServer19{}
@@ -110,6 +115,13 @@ func (r *FakeRuntimeServer19) SetFakeContainerStats(containerStats []*runtimeapi
 	}
 }
 
+func (r *FakeRuntimeServer19) SetFakeStatsUnimplemented(unimplemented bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.StatsUnimplemented = unimplemented
+}
+
 func NewFakeRuntimeServer19(journal Journal, streamUrl string) *FakeRuntimeServer19 {
 	ready := true
 	runtimeReadyStr := runtimeapi.RuntimeReady
@@ -440,6 +452,9 @@ func (r *FakeRuntimeServer19) ListContainerStats(ctx context.Context, in *runtim
 	defer r.Unlock()
 
 	r.journal.Record("ListContainerStats")
+	if r.StatsUnimplemented {
+		return nil, grpc.Errorf(codes.Unimplemented, "container stats are not implemented")
+	}
 
 	var result []*runtimeapi.ContainerStats
 	for _, c := range r.Containers {
@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"google.golang.org/grpc/credentials"
+)
+
+// BackendTLS denotes TLS settings for a runtime that's connected
+// to over TCP.
+type BackendTLS struct {
+	// CAFile is the path to PEM file with CA certificates used to
+	// verify the runtime's certificate. If it's empty, the system
+	// CA certificates are used.
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile is the path to PEM file with the client certificate.
+	CertFile string `json:"certFile,omitempty"`
+	// KeyFile is the path to PEM file with the client key.
+	KeyFile string `json:"keyFile,omitempty"`
+	// ServerName overrides the server name used to verify the
+	// runtime's certificate.
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// LoadBackendTLS loads a YAML or JSON file that maps runtime ids to
+// TLS settings to be used for the runtimes.
+func LoadBackendTLS(path string) (map[string]*BackendTLS, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var backendTLS map[string]*BackendTLS
+	if err := yaml.Unmarshal(data, &backendTLS); err != nil {
+		return nil, fmt.Errorf("error parsing %q: %v", path, err)
+	}
+	return backendTLS, nil
+}
+
+// credentials loads the certificates and returns the transport
+// credentials for the connection to the runtime at the specified
+// tcp:// address. Unless ServerName is set, the runtime's certificate
+// is verified against the host part of the address, as gRPC would use
+// the address with the tcp:// scheme for that.
+func (b *BackendTLS) credentials(addr string) (credentials.TransportCredentials, error) {
+	config := &tls.Config{ServerName: b.ServerName}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(strings.TrimPrefix(addr, "tcp://"))
+		if err != nil {
+			return nil, fmt.Errorf("bad runtime address %q: %v", addr, err)
+		}
+		config.ServerName = host
+	}
+	if b.CAFile != "" {
+		pem, err := ioutil.ReadFile(b.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", b.CAFile)
+		}
+	}
+	switch {
+	case b.CertFile != "" && b.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	case b.CertFile != "" || b.KeyFile != "":
+		return nil, errors.New("both certFile and keyFile must be specified for the client certificate")
+	}
+	return credentials.NewTLS(config), nil
+}
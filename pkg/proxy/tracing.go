@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+)
+
+const traceFamily = "criproxy"
+
+// tracingEnabled is set by EnableTracing. No traces are recorded
+// unless it's set.
+var tracingEnabled bool
+
+// EnableTracing makes the proxy record a trace for each CRI call
+// made by kubelet. The traces include the calls passed to the
+// runtimes and can be viewed via TraceHandler. By default, the
+// traces are only served to localhost. If allowRemote is true, they
+// can be viewed from any host, with the event details such as image
+// names redacted for non-local clients.
+func EnableTracing(allowRemote bool) {
+	tracingEnabled = true
+	if !allowRemote {
+		return
+	}
+	localAuth := trace.AuthRequest
+	trace.AuthRequest = func(req *http.Request) (any, sensitive bool) {
+		if ok, sensitive := localAuth(req); ok {
+			return true, sensitive
+		}
+		return true, false
+	}
+}
+
+// TraceHandler serves the recorded traces.
+func TraceHandler(w http.ResponseWriter, req *http.Request) {
+	trace.Traces(w, req)
+}
+
+// startCallTrace starts a trace for a CRI call made by kubelet.
+// It returns nil if tracing is disabled.
+func startCallTrace(ctx context.Context, fullMethod string) (context.Context, trace.Trace) {
+	if !tracingEnabled {
+		return ctx, nil
+	}
+	tr := trace.New(traceFamily, fullMethod)
+	return trace.NewContext(ctx, tr), tr
+}
+
+// setCallTraceAttributes adds the image and pod UID of the request
+// to the trace, if there are any. These are marked as sensitive.
+func setCallTraceAttributes(tr trace.Trace, req CRIObject) {
+	if tr == nil {
+		return
+	}
+	if o, ok := req.(ImageObject); ok && o.Image() != "" {
+		tr.LazyLog(sensitiveEvent{"image: %s", []interface{}{o.Image()}}, true)
+	}
+	if o, ok := req.(PodUidObject); ok && o.PodUid() != "" {
+		tr.LazyLog(sensitiveEvent{"pod uid: %s", []interface{}{o.PodUid()}}, true)
+	}
+}
+
+// sensitiveEvent is a trace event that's only shown to the clients
+// that are allowed to see sensitive data, i.e. the local ones.
+type sensitiveEvent struct {
+	format string
+	args   []interface{}
+}
+
+func (e sensitiveEvent) String() string {
+	return fmt.Sprintf(e.format, e.args...)
+}
+
+// traceRuntimeCall records a call that's passed to a runtime in
+// the trace of the kubelet call, if any. It returns a function that
+// must be invoked with the result of the call.
+func traceRuntimeCall(ctx context.Context, method string, c client) func(error) {
+	tr, ok := trace.FromContext(ctx)
+	if !ok {
+		return func(error) {}
+	}
+	runtime := runtimeLabel(c)
+	tr.LazyPrintf("-> %s: %s", runtime, method)
+	start := time.Now()
+	return func(err error) {
+		if err != nil {
+			tr.LazyPrintf("<- %s: %s: error after %v: %v", runtime, method, time.Since(start), err)
+		} else {
+			tr.LazyPrintf("<- %s: %s: ok after %v", runtime, method, time.Since(start))
+		}
+	}
+}
+
+// endCallTrace records the error, if any, and finishes the trace.
+func endCallTrace(tr trace.Trace, err error) {
+	if tr == nil {
+		return
+	}
+	if err != nil {
+		tr.LazyPrintf("error: %v", err)
+		tr.SetError()
+	}
+	tr.Finish()
+}
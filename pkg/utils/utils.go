@@ -16,11 +16,20 @@ limitations under the License.
 package utils
 
 import (
+	"bytes"
+	"flag"
+	"fmt"
 	"net"
 	"net/url"
 	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/golang/glog"
 	knet "k8s.io/apimachinery/pkg/util/net"
@@ -33,33 +42,80 @@ const (
 	connectAttemptInterval = 500 * time.Millisecond
 )
 
-// dial creates a net.Conn by unix socket addr.
+const tcpAddrPrefix = "tcp://"
+
+// IsTCPAddr returns true if addr denotes a TCP address in
+// tcp://host:port form rather than a unix socket path.
+func IsTCPAddr(addr string) bool {
+	return strings.HasPrefix(addr, tcpAddrPrefix)
+}
+
+// dial creates a net.Conn by unix socket addr or tcp://host:port addr.
 func Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	if IsTCPAddr(addr) {
+		return net.DialTimeout("tcp", addr[len(tcpAddrPrefix):], timeout)
+	}
 	return net.DialTimeout("unix", addr, timeout)
 }
 
+// WaitForSocket waits for the socket to appear and accept connections,
+// and for extraCheck, if specified, to succeed. If maxAttempts is
+// negative, it waits indefinitely. When all of the attempts fail, the
+// error tells which of these conditions hasn't been met.
 func WaitForSocket(path string, maxAttempts int, extraCheck func() error) error {
 	var err error
 	var conn net.Conn
+	var what string
 	for n := 0; maxAttempts < 0 || n < maxAttempts; n++ {
-		if _, err = os.Stat(path); err != nil {
+		if _, err = os.Stat(path); err != nil && !IsTCPAddr(path) {
+			what = "socket was never created"
 			glog.V(1).Infof("attempt %d: %q is not here yet: %v", n, path, err)
 		} else if conn, err = Dial(path, connectWaitTimeout); err != nil {
+			what = "socket doesn't accept connections"
 			glog.V(1).Infof("attempt %d: can't connect to %q yet: %v", n, path, err)
 		} else {
 			conn.Close()
-			if extraCheck != nil {
-				err = extraCheck()
-				if err != nil {
-					glog.V(1).Infof("attempt %d: extra check failed for %q: %v", n, path, err)
-					continue
-				}
+			if extraCheck == nil {
+				return nil
 			}
-			break
+			if err = extraCheck(); err == nil {
+				return nil
+			}
+			what = "socket accepts connections but the check failed"
+			glog.V(1).Infof("attempt %d: extra check failed for %q: %v", n, path, err)
 		}
 		time.Sleep(connectAttemptInterval)
 	}
-	return err
+	if err != nil {
+		return fmt.Errorf("%s: %s: %v", path, what, err)
+	}
+	return nil
+}
+
+// ParseFileMode parses an octal file mode such as 0660 that
+// specifies permission bits.
+func ParseFileMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad file mode %q: %v", s, err)
+	}
+	if mode == 0 || mode&^uint64(os.ModePerm) != 0 {
+		return 0, fmt.Errorf("bad file mode %q: must be between 0001 and 0777", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// LookupGid returns the id of the group specified by its name or
+// numeric id.
+func LookupGid(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
 }
 
 func GetStreamUrl(port int) (*url.URL, error) {
@@ -72,3 +128,195 @@ func GetStreamUrl(port int) (*url.URL, error) {
 		Host:   net.JoinHostPort(bindAddress.String(), strconv.Itoa(port)),
 	}, nil
 }
+
+// ParseStreamUrl parses the streaming url making sure that IPv6
+// addresses in it are enclosed in brackets, as otherwise the port
+// can't be told apart from the address.
+func ParseStreamUrl(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream url %q: %v", s, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid stream url %q: no host specified", s)
+	}
+	if !strings.HasPrefix(u.Host, "[") && strings.Contains(u.Hostname(), ":") {
+		return nil, fmt.Errorf("invalid stream url %q: IPv6 address must be enclosed in brackets", s)
+	}
+	return u, nil
+}
+
+// ParseStreamAddress validates the host:port address the streaming
+// server is reachable on and returns the corresponding streaming url.
+func ParseStreamAddress(addr string) (*url.URL, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bad streaming server address %q: %v", addr, err)
+	}
+	if host == "" {
+		return nil, fmt.Errorf("bad streaming server address %q: no host specified", addr)
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return nil, fmt.Errorf("bad streaming server address %q: %s is not a reachable address", addr, host)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, fmt.Errorf("bad streaming server address %q: invalid port %q", addr, portStr)
+	}
+	if _, err := net.LookupHost(host); err != nil {
+		return nil, fmt.Errorf("can't resolve streaming server address %q: %v", addr, err)
+	}
+	return &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(host, portStr),
+	}, nil
+}
+
+// FlagEnvName returns the name of the environment variable that
+// corresponds to the flag, e.g. CRIPROXY_STREAM_URL for streamUrl
+// flag with CRIPROXY_ prefix.
+func FlagEnvName(prefix, flagName string) string {
+	var buf bytes.Buffer
+	buf.WriteString(prefix)
+	for i, c := range flagName {
+		switch {
+		case c == '-' || c == '.':
+			c = '_'
+		case unicode.IsUpper(c) && i > 0 && unicode.IsLower(rune(flagName[i-1])):
+			buf.WriteRune('_')
+		}
+		buf.WriteRune(unicode.ToUpper(c))
+	}
+	return buf.String()
+}
+
+// SetFlagsFromEnv sets the flags that weren't set on the command
+// line from the corresponding environment variables (see
+// FlagEnvName). So the flags take precedence over the environment,
+// and the environment takes precedence over the defaults.
+func SetFlagsFromEnv(fs *flag.FlagSet, prefix string) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		envName := FlagEnvName(prefix, f.Name)
+		if value, found := os.LookupEnv(envName); found {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("bad value of %s: %v", envName, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// CleanupOrphanedSockets removes the criproxy sockets (unix sockets
+// named criproxy*) in the specified directory that nothing is
+// listening on. A socket is only removed if connecting to it is
+// refused, so live sockets are never removed. It returns the paths
+// of the removed sockets.
+func CleanupOrphanedSockets(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "criproxy*"))
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, path := range paths {
+		fi, err := os.Lstat(path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return removed, err
+		}
+		if fi.Mode()&os.ModeSocket == 0 {
+			continue
+		}
+		conn, err := Dial(path, connectWaitTimeout)
+		if err == nil {
+			conn.Close()
+			continue
+		}
+		if !isConnRefused(err) {
+			glog.Warningf("Not removing socket %q: %v", path, err)
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		glog.V(1).Infof("Removed orphaned socket %q", path)
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+func isConnRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok {
+			return sysErr.Err == syscall.ECONNREFUSED
+		}
+	}
+	return false
+}
+
+// glogSeverities lists the severities glog writes separate log
+// files for
+var glogSeverities = []string{"INFO", "WARNING", "ERROR", "FATAL"}
+
+// PruneLogFiles removes the old log files written by glog for the
+// specified program in dir, keeping the newest maxBackups files
+// of each severity besides the current one. glog names the files
+// program.host.user.log.SEVERITY.timestamp.pid and rotates them
+// itself, but it never removes the old ones. It returns the paths of
+// the removed files.
+func PruneLogFiles(dir, program string, maxBackups int) ([]string, error) {
+	if maxBackups < 0 {
+		maxBackups = 0
+	}
+	var removed []string
+	for _, severity := range glogSeverities {
+		paths, err := filepath.Glob(filepath.Join(dir, program+".*.log."+severity+".*"))
+		if err != nil {
+			return removed, err
+		}
+		type logFile struct {
+			path    string
+			modTime time.Time
+		}
+		var files []logFile
+		for _, path := range paths {
+			fi, err := os.Lstat(path)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return removed, err
+			}
+			if fi.Mode().IsRegular() {
+				files = append(files, logFile{path, fi.ModTime()})
+			}
+		}
+		if len(files) <= maxBackups+1 {
+			continue
+		}
+		// newest first; the names include the creation time
+		// so they're used to break ties
+		sort.Slice(files, func(i, j int) bool {
+			if !files[i].modTime.Equal(files[j].modTime) {
+				return files[i].modTime.After(files[j].modTime)
+			}
+			return files[i].path > files[j].path
+		})
+		for _, f := range files[maxBackups+1:] {
+			if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+			removed = append(removed, f.path)
+		}
+	}
+	return removed, nil
+}
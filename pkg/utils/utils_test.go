@@ -0,0 +1,285 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFlagEnvName(t *testing.T) {
+	for flagName, expected := range map[string]string{
+		"connect":       "CRIPROXY_CONNECT",
+		"streamUrl":     "CRIPROXY_STREAM_URL",
+		"httpListen":    "CRIPROXY_HTTP_LISTEN",
+		"log_dir":       "CRIPROXY_LOG_DIR",
+		"some-flag.foo": "CRIPROXY_SOME_FLAG_FOO",
+	} {
+		if envName := FlagEnvName("CRIPROXY_", flagName); envName != expected {
+			t.Errorf("FlagEnvName(%q): %q instead of %q", flagName, envName, expected)
+		}
+	}
+}
+
+func TestSetFlagsFromEnv(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	listen := fs.String("listen", "/run/criproxy.sock", "")
+	connect := fs.String("connect", "/var/run/dockershim.sock", "")
+	streamPort := fs.Int("streamPort", 11250, "")
+	defaultRuntime := fs.String("defaultRuntime", "", "")
+	if err := fs.Parse([]string{"-connect", "/run/flag.sock"}); err != nil {
+		t.Fatalf("Parse(): %v", err)
+	}
+
+	os.Setenv("CRIPROXY_CONNECT", "/run/env.sock")
+	defer os.Unsetenv("CRIPROXY_CONNECT")
+	os.Setenv("CRIPROXY_STREAM_PORT", "11251")
+	defer os.Unsetenv("CRIPROXY_STREAM_PORT")
+	os.Setenv("CRIPROXY_DEFAULT_RUNTIME", "alt")
+	defer os.Unsetenv("CRIPROXY_DEFAULT_RUNTIME")
+
+	if err := SetFlagsFromEnv(fs, "CRIPROXY_"); err != nil {
+		t.Fatalf("SetFlagsFromEnv(): %v", err)
+	}
+	if *connect != "/run/flag.sock" {
+		t.Errorf("the flag didn't take precedence over the environment: connect = %q", *connect)
+	}
+	if *streamPort != 11251 {
+		t.Errorf("streamPort wasn't set from the environment: %d", *streamPort)
+	}
+	if *defaultRuntime != "alt" {
+		t.Errorf("defaultRuntime wasn't set from the environment: %q", *defaultRuntime)
+	}
+	if *listen != "/run/criproxy.sock" {
+		t.Errorf("listen doesn't have the default value: %q", *listen)
+	}
+
+	os.Setenv("CRIPROXY_STREAM_PORT", "notanumber")
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("streamPort", 11250, "")
+	if err := SetFlagsFromEnv(fs, "CRIPROXY_"); err == nil {
+		t.Errorf("SetFlagsFromEnv() didn't fail for a bad value")
+	}
+}
+
+func TestCleanupOrphanedSockets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "criproxy-sockets")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	live := filepath.Join(dir, "criproxy.sock")
+	ln, err := net.Listen("unix", live)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+
+	orphaned := filepath.Join(dir, "criproxy-old.sock")
+	orphanedLn, err := net.Listen("unix", orphaned)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	// keep the socket file after closing the listener
+	orphanedLn.(*net.UnixListener).SetUnlinkOnClose(false)
+	orphanedLn.Close()
+
+	other := filepath.Join(dir, "other.sock")
+	otherLn, err := net.Listen("unix", other)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	otherLn.(*net.UnixListener).SetUnlinkOnClose(false)
+	otherLn.Close()
+
+	notSocket := filepath.Join(dir, "criproxy.conf")
+	if err := ioutil.WriteFile(notSocket, nil, 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+
+	removed, err := CleanupOrphanedSockets(dir)
+	if err != nil {
+		t.Fatalf("CleanupOrphanedSockets(): %v", err)
+	}
+	if !reflect.DeepEqual(removed, []string{orphaned}) {
+		t.Errorf("bad list of removed sockets: %v", removed)
+	}
+	for _, path := range []string{live, other, notSocket} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+	if _, err := os.Lstat(orphaned); !os.IsNotExist(err) {
+		t.Errorf("orphaned socket was not removed")
+	}
+}
+
+func TestPruneLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "criproxy-log")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var infoFiles []string
+	now := time.Now()
+	for n, ts := range []string{"20181206-143134", "20181207-090000", "20181208-101010", "20181209-111111"} {
+		for _, severity := range []string{"INFO", "ERROR"} {
+			path := filepath.Join(dir, fmt.Sprintf("criproxy.node1.root.log.%s.%s.42", severity, ts))
+			if err := ioutil.WriteFile(path, []byte("log\n"), 0644); err != nil {
+				t.Fatalf("WriteFile(): %v", err)
+			}
+			modTime := now.Add(time.Duration(n-4) * time.Hour)
+			if err := os.Chtimes(path, modTime, modTime); err != nil {
+				t.Fatalf("Chtimes(): %v", err)
+			}
+			if severity == "INFO" {
+				infoFiles = append(infoFiles, path)
+			}
+		}
+	}
+	// the symlinks to the current files and the files of other
+	// programs are never removed
+	if err := os.Symlink(infoFiles[3], filepath.Join(dir, "criproxy.INFO")); err != nil {
+		t.Fatalf("Symlink(): %v", err)
+	}
+	other := filepath.Join(dir, "kubelet.node1.root.log.INFO.20181206-143134.43")
+	if err := ioutil.WriteFile(other, []byte("log\n"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+
+	removed, err := PruneLogFiles(dir, "criproxy", 2)
+	if err != nil {
+		t.Fatalf("PruneLogFiles(): %v", err)
+	}
+	// the current file and 2 backups are kept for each severity
+	expectedRemoved := []string{
+		infoFiles[0],
+		filepath.Join(dir, "criproxy.node1.root.log.ERROR.20181206-143134.42"),
+	}
+	if !reflect.DeepEqual(removed, expectedRemoved) {
+		t.Errorf("bad list of removed files: %v instead of %v", removed, expectedRemoved)
+	}
+	for _, path := range append(infoFiles[1:], other, filepath.Join(dir, "criproxy.INFO")) {
+		if _, err := os.Lstat(path); err != nil {
+			t.Errorf("%s was removed: %v", path, err)
+		}
+	}
+
+	if _, err := PruneLogFiles(dir, "criproxy", 0); err != nil {
+		t.Fatalf("PruneLogFiles(): %v", err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "criproxy.*.log.INFO.*"))
+	if err != nil {
+		t.Fatalf("Glob(): %v", err)
+	}
+	if !reflect.DeepEqual(paths, []string{infoFiles[3]}) {
+		t.Errorf("only the current file should be kept with no backups, got %v", paths)
+	}
+}
+
+func TestParseStreamUrl(t *testing.T) {
+	for _, tc := range []struct {
+		url, host string
+	}{
+		{"http://10.0.0.5:11250/", "10.0.0.5:11250"},
+		{"http://[fd00::5]:11250/", "[fd00::5]:11250"},
+		{"http://fd00::5:11250/", ""},
+		{"/cri", ""},
+	} {
+		u, err := ParseStreamUrl(tc.url)
+		switch {
+		case tc.host == "" && err == nil:
+			t.Errorf("ParseStreamUrl(%q) didn't fail", tc.url)
+		case tc.host != "" && err != nil:
+			t.Errorf("ParseStreamUrl(%q): %v", tc.url, err)
+		case tc.host != "" && u.Host != tc.host:
+			t.Errorf("ParseStreamUrl(%q): bad host %q instead of %q", tc.url, u.Host, tc.host)
+		}
+	}
+}
+
+func TestParseStreamAddress(t *testing.T) {
+	for _, tc := range []struct {
+		addr, url string
+	}{
+		{"10.0.0.5:11250", "http://10.0.0.5:11250"},
+		{"[fd00::5]:11250", "http://[fd00::5]:11250"},
+		{"fd00::5:11250", ""},
+		{"[::]:11250", ""},
+		{"0.0.0.0:11250", ""},
+		{"10.0.0.5:0", ""},
+	} {
+		u, err := ParseStreamAddress(tc.addr)
+		switch {
+		case tc.url == "" && err == nil:
+			t.Errorf("ParseStreamAddress(%q) didn't fail", tc.addr)
+		case tc.url != "" && err != nil:
+			t.Errorf("ParseStreamAddress(%q): %v", tc.addr, err)
+		case tc.url != "" && u.String() != tc.url:
+			t.Errorf("ParseStreamAddress(%q): %q instead of %q", tc.addr, u.String(), tc.url)
+		}
+	}
+}
+
+func TestWaitForSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "criproxy-sockets")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	noFile := filepath.Join(dir, "nonexistent.sock")
+	if err := WaitForSocket(noFile, 2, nil); err == nil || !strings.Contains(err.Error(), "never created") {
+		t.Errorf("bad error for a nonexistent socket: %v", err)
+	}
+
+	noListener := filepath.Join(dir, "orphaned.sock")
+	ln, err := net.Listen("unix", noListener)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	if err := WaitForSocket(noListener, 2, nil); err == nil || !strings.Contains(err.Error(), "doesn't accept connections") {
+		t.Errorf("bad error for a socket without a listener: %v", err)
+	}
+
+	live := filepath.Join(dir, "live.sock")
+	ln, err = net.Listen("unix", live)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer ln.Close()
+	checkErr := errors.New("not ready")
+	if err := WaitForSocket(live, 2, func() error { return checkErr }); err == nil || !strings.Contains(err.Error(), "check failed") {
+		t.Errorf("bad error for a failing check: %v", err)
+	}
+	if err := WaitForSocket(live, 2, func() error { return nil }); err != nil {
+		t.Errorf("WaitForSocket(): %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version contains the version of CRI Proxy. It's set
+// during the build using -ldflags, e.g.
+// go build -ldflags "-X github.com/Mirantis/criproxy/pkg/version.Version=0.12.0"
+package version
+
+var (
+	// Version is the version of CRI Proxy.
+	Version = "0.0.0"
+	// Commit is the git commit CRI Proxy is built from.
+	Commit = "unknown"
+)
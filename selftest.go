@@ -0,0 +1,231 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/Mirantis/criproxy/pkg/proxy"
+	"github.com/Mirantis/criproxy/pkg/runtimeapis"
+	runtimeapi "github.com/Mirantis/criproxy/pkg/runtimeapis/v1_12"
+	"github.com/Mirantis/criproxy/pkg/utils"
+)
+
+const (
+	// selfTestTimeout limits the duration of the whole self-test,
+	// including the image pull
+	selfTestTimeout = 5 * time.Minute
+	selfTestName    = "criproxy-selftest"
+	// targetRuntimeAnnotation is the pod annotation that makes
+	// the proxy run the pod using a runtime other than the primary
+	// one
+	targetRuntimeAnnotation = "kubernetes.io/target-runtime"
+)
+
+// selfTestCRIVersions maps the values of -selfTestCRIVersion to the
+// CRI versions served by the proxy
+var selfTestCRIVersions = map[string]proxy.CRIVersion{
+	"v1alpha1": criVersions[0],
+	"v1alpha2": criVersions[1],
+}
+
+// selfTester runs a sequence of CRI calls against the proxy socket
+type selfTester struct {
+	conn       *grpc.ClientConn
+	criVersion proxy.CRIVersion
+	// runtime is the id of the runtime to run the pod with
+	runtime string
+	failed  bool
+}
+
+// step runs a single self-test step and reports its result
+func (st *selfTester) step(name string, fn func() error) bool {
+	if err := fn(); err != nil {
+		fmt.Printf("FAIL\t%s: %v\n", name, err)
+		st.failed = true
+		return false
+	}
+	fmt.Printf("PASS\t%s\n", name)
+	return true
+}
+
+// invoke calls CRI method using the CRI version of the self-test.
+// The requests and the responses are v1alpha2 objects that are
+// converted to the older CRI version and back if necessary.
+func (st *selfTester) invoke(ctx context.Context, method string, req, resp interface{}) (interface{}, error) {
+	if _, legacy := st.criVersion.(proxy.UpgradableCRIVersion); legacy {
+		var err error
+		if req, err = runtimeapis.Downgrade(req); err != nil {
+			return nil, err
+		}
+		if resp, err = runtimeapis.Downgrade(resp); err != nil {
+			return nil, err
+		}
+	}
+	if err := grpc.Invoke(ctx, fmt.Sprintf("/%s.%s", st.criVersion.ProtoPackage(), method), req, resp, st.conn); err != nil {
+		return nil, err
+	}
+	return runtimeapis.Upgrade(resp)
+}
+
+// selfTest connects to the proxy socket and runs a minimal pod
+// lifecycle against the default runtime, or against the primary
+// one if there's no default runtime, removing everything it creates
+// even if some of the steps fail. The runtimes are determined using
+// the same options as the ones used by the proxy.
+func selfTest(connect, listen, image, criVersionName string) error {
+	criVersion, found := selfTestCRIVersions[criVersionName]
+	if !found {
+		return fmt.Errorf("unknown CRI version %q", criVersionName)
+	}
+	opts, err := proxyOptions()
+	if err != nil {
+		return err
+	}
+	p, err := proxy.NewRuntimeProxy(criVersion, strings.Split(connect, ","), *connectionTimeout, &url.URL{}, opts)
+	if err != nil {
+		return fmt.Errorf("error initializing CRI proxy: %v", err)
+	}
+	// the pod and the image must be handled by the same runtime
+	runtime, _ := p.DefaultRuntime()
+	if image, err = p.RuntimeImageName(runtime, image); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+
+	conn, err := grpc.Dial(listen, grpc.WithInsecure(), grpc.WithTimeout(*connectionTimeout), grpc.WithDialer(utils.Dial))
+	if err != nil {
+		return fmt.Errorf("error connecting to the proxy socket %s: %v", listen, err)
+	}
+	defer conn.Close()
+
+	st := &selfTester{
+		conn:       conn,
+		criVersion: criVersion,
+		runtime:    runtime,
+	}
+	st.run(ctx, image)
+	if st.failed {
+		return errors.New("self-test failed")
+	}
+	return nil
+}
+
+// cleanup runs a self-test step that removes the objects created by
+// the test. It doesn't use the self-test context so as to be able to
+// clean up after the test times out
+func (st *selfTester) cleanup(name string, fn func(ctx context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), *connectionTimeout)
+	defer cancel()
+	st.step(name, func() error { return fn(ctx) })
+}
+
+func (st *selfTester) run(ctx context.Context, image string) {
+	if !st.step("Version", func() error {
+		out, err := st.invoke(ctx, "RuntimeService/Version", &runtimeapi.VersionRequest{}, &runtimeapi.VersionResponse{})
+		if err == nil {
+			resp := out.(*runtimeapi.VersionResponse)
+			fmt.Printf("\truntime: %s %s, CRI %s (%s)\n", resp.RuntimeName, resp.RuntimeVersion, resp.RuntimeApiVersion, st.criVersion.ProtoPackage())
+		}
+		return err
+	}) {
+		return
+	}
+
+	var imageRef string
+	if !st.step("PullImage "+image, func() error {
+		out, err := st.invoke(ctx, "ImageService/PullImage", &runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: image},
+		}, &runtimeapi.PullImageResponse{})
+		if err != nil {
+			return err
+		}
+		// the proxy treats the images of the runtimes that
+		// aren't connected as absent
+		if imageRef = out.(*runtimeapi.PullImageResponse).ImageRef; imageRef == "" {
+			return errors.New("no image reference returned, the runtime may be unavailable")
+		}
+		return nil
+	}) {
+		return
+	}
+
+	uid := fmt.Sprintf("%s-%d", selfTestName, time.Now().UnixNano())
+	sandboxConfig := &runtimeapi.PodSandboxConfig{
+		Metadata: &runtimeapi.PodSandboxMetadata{
+			Name:      selfTestName,
+			Uid:       uid,
+			Namespace: "default",
+		},
+		Hostname: selfTestName,
+		Labels:   map[string]string{"criproxy-selftest": uid},
+		Linux:    &runtimeapi.LinuxPodSandboxConfig{},
+	}
+	if st.runtime != "" {
+		sandboxConfig.Annotations = map[string]string{targetRuntimeAnnotation: st.runtime}
+	}
+	var podId string
+	if !st.step("RunPodSandbox", func() error {
+		out, err := st.invoke(ctx, "RuntimeService/RunPodSandbox", &runtimeapi.RunPodSandboxRequest{Config: sandboxConfig}, &runtimeapi.RunPodSandboxResponse{})
+		if err == nil {
+			podId = out.(*runtimeapi.RunPodSandboxResponse).PodSandboxId
+		}
+		return err
+	}) {
+		return
+	}
+	defer st.cleanup("RemovePodSandbox", func(ctx context.Context) error {
+		if _, err := st.invoke(ctx, "RuntimeService/StopPodSandbox", &runtimeapi.StopPodSandboxRequest{PodSandboxId: podId}, &runtimeapi.StopPodSandboxResponse{}); err != nil {
+			return err
+		}
+		_, err := st.invoke(ctx, "RuntimeService/RemovePodSandbox", &runtimeapi.RemovePodSandboxRequest{PodSandboxId: podId}, &runtimeapi.RemovePodSandboxResponse{})
+		return err
+	})
+
+	var containerId string
+	if !st.step("CreateContainer", func() error {
+		out, err := st.invoke(ctx, "RuntimeService/CreateContainer", &runtimeapi.CreateContainerRequest{
+			PodSandboxId: podId,
+			Config: &runtimeapi.ContainerConfig{
+				Metadata: &runtimeapi.ContainerMetadata{Name: selfTestName},
+				Image:    &runtimeapi.ImageSpec{Image: imageRef},
+				Command:  []string{"/bin/true"},
+				Linux:    &runtimeapi.LinuxContainerConfig{},
+			},
+			SandboxConfig: sandboxConfig,
+		}, &runtimeapi.CreateContainerResponse{})
+		if err == nil {
+			containerId = out.(*runtimeapi.CreateContainerResponse).ContainerId
+		}
+		return err
+	}) {
+		return
+	}
+	st.cleanup("RemoveContainer", func(ctx context.Context) error {
+		_, err := st.invoke(ctx, "RuntimeService/RemoveContainer", &runtimeapi.RemoveContainerRequest{ContainerId: containerId}, &runtimeapi.RemoveContainerResponse{})
+		return err
+	})
+}
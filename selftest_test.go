@@ -0,0 +1,177 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Mirantis/criproxy/pkg/proxy"
+	proxytest "github.com/Mirantis/criproxy/pkg/proxy/testing"
+)
+
+type makeFakeCriServerFunc func(journal proxytest.Journal, streamUrl string) proxytest.FakeCriServer
+
+type serverWithReadinessFeedback interface {
+	Serve(addr string, readyCh chan struct{}) error
+}
+
+func startServer(t *testing.T, s serverWithReadinessFeedback, addr string) {
+	readyCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		if err := s.Serve(addr, readyCh); err != nil {
+			errCh <- err
+		}
+	}()
+	select {
+	case err := <-errCh:
+		t.Fatalf("server stopped with error: %v", err)
+	case <-readyCh:
+	}
+}
+
+func setFlag(t *testing.T, name, value string) func() {
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("error setting -%s: %v", name, err)
+	}
+	return func() { flag.Set(name, old) }
+}
+
+func TestSelfTest(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		makers           []makeFakeCriServerFunc
+		criVersion       string
+		defaultRuntime   string
+		noDefaultRuntime bool
+		// expectedRuntime is the journal prefix of the runtime
+		// that's expected to run the pod
+		expectedRuntime string
+	}{
+		{
+			name:            "CRI 1.9 runtimes",
+			makers:          []makeFakeCriServerFunc{proxytest.NewFakeCriServer19, proxytest.NewFakeCriServer19},
+			criVersion:      "v1alpha1",
+			expectedRuntime: "1/",
+		},
+		{
+			name:            "CRI 1.12 runtimes",
+			makers:          []makeFakeCriServerFunc{proxytest.NewFakeCriServer110, proxytest.NewFakeCriServer110},
+			criVersion:      "v1alpha2",
+			expectedRuntime: "1/",
+		},
+		{
+			name:            "CRI 1.12 runtimes via v1alpha1",
+			makers:          []makeFakeCriServerFunc{proxytest.NewFakeCriServer110, proxytest.NewFakeCriServer110},
+			criVersion:      "v1alpha1",
+			expectedRuntime: "1/",
+		},
+		{
+			name:            "CRI 1.9 default runtime",
+			makers:          []makeFakeCriServerFunc{proxytest.NewFakeCriServer19, proxytest.NewFakeCriServer19},
+			criVersion:      "v1alpha1",
+			defaultRuntime:  "alt",
+			expectedRuntime: "2/",
+		},
+		{
+			name:            "CRI 1.12 default runtime",
+			makers:          []makeFakeCriServerFunc{proxytest.NewFakeCriServer110, proxytest.NewFakeCriServer110},
+			criVersion:      "v1alpha2",
+			defaultRuntime:  "alt",
+			expectedRuntime: "2/",
+		},
+		{
+			name:             "no default runtime",
+			makers:           []makeFakeCriServerFunc{proxytest.NewFakeCriServer110, proxytest.NewFakeCriServer110},
+			criVersion:       "v1alpha2",
+			noDefaultRuntime: true,
+			expectedRuntime:  "1/",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "criproxy-selftest")
+			if err != nil {
+				t.Fatalf("TempDir(): %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			journal := proxytest.NewSimpleJournal()
+			addrs := []string{filepath.Join(dir, "runtime1.sock"), filepath.Join(dir, "runtime2.sock")}
+			for n, maker := range tc.makers {
+				server := maker(proxytest.NewPrefixJournal(journal, []string{"1/", "2/"}[n]), "/cri")
+				startServer(t, server, addrs[n])
+				defer server.Stop()
+			}
+			connect := addrs[0] + ",alt:" + addrs[1]
+
+			defer setFlag(t, "defaultRuntime", tc.defaultRuntime)()
+			if tc.noDefaultRuntime {
+				defer setFlag(t, "noDefaultRuntime", "true")()
+			}
+			opts, err := proxyOptions()
+			if err != nil {
+				t.Fatalf("proxyOptions(): %v", err)
+			}
+			var interceptors []proxy.Interceptor
+			for _, criVersion := range criVersions {
+				p, err := proxy.NewRuntimeProxy(criVersion, strings.Split(connect, ","), *connectionTimeout, &url.URL{}, opts)
+				if err != nil {
+					t.Fatalf("NewRuntimeProxy(): %v", err)
+				}
+				interceptors = append(interceptors, p)
+				// make sure the self-test doesn't race with the
+				// connection to the second runtime. The newer CRI
+				// versions can't be used with the older runtimes,
+				// so only the version used by the test is checked
+				if criVersion == selfTestCRIVersions[tc.criVersion] {
+					if err := p.WaitForRuntimes(); err != nil {
+						t.Fatalf("WaitForRuntimes(): %v", err)
+					}
+				}
+			}
+			proxyServer := proxy.NewServer(interceptors, nil)
+			listen := filepath.Join(dir, "criproxy.sock")
+			startServer(t, proxyServer, listen)
+			defer proxyServer.Stop()
+
+			if err := selfTest(connect, listen, "busybox", tc.criVersion); err != nil {
+				t.Fatalf("selfTest(): %v", err)
+			}
+
+			journal.Lock()
+			defer journal.Unlock()
+			for _, method := range []string{"image/PullImage", "runtime/RunPodSandbox", "runtime/CreateContainer", "runtime/RemoveContainer", "runtime/RemovePodSandbox"} {
+				found := false
+				for _, item := range journal.Items {
+					if item == tc.expectedRuntime+method {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("%s not called for runtime %q", method, tc.expectedRuntime)
+				}
+			}
+		})
+	}
+}